@@ -1,13 +1,14 @@
 package handlers
 
 import (
-	"bytes"
-	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/venkssa/eventsourcing/internal/blob"
@@ -20,45 +21,115 @@ type BlobHandler struct {
 	aggregateRepo blob.AggregateRepository
 }
 
-func NewBlobHandler(logger log.Logger, aggregateRepo blob.AggregateRepository) HandlerRegisterer {
+// NewBlobHandler registers the blob routes. Request bodies larger than maxBodySize bytes are rejected with 413;
+// a maxBodySize of 0 does not limit them.
+func NewBlobHandler(logger log.Logger, aggregateRepo blob.AggregateRepository, maxBodySize int64) HandlerRegisterer {
 	hdlr := &BlobHandler{aggregateRepo: aggregateRepo}
 	hdlr.HandlerRegisterFunc = HandlerRegisterFunc(func(muxRouter *mux.Router) {
 		s := muxRouter.PathPrefix("/blob").Subrouter()
 
 		s.HandleFunc("/{id}", withErrorHandler(logger, hdlr.Find)).Methods(http.MethodGet)
-		s.HandleFunc("/{id}", withErrorHandler(logger, hdlr.Create)).Methods(http.MethodPost)
-		s.HandleFunc("/{id}", withErrorHandler(logger, hdlr.Update)).Methods(http.MethodPut)
+		s.HandleFunc("/{id}", withErrorHandler(logger, withMaxBodySize(maxBodySize, hdlr.Create))).Methods(http.MethodPost)
+		s.HandleFunc("/{id}", withErrorHandler(logger, withMaxBodySize(maxBodySize, hdlr.Update))).Methods(http.MethodPut)
 		s.HandleFunc("/{id}", withErrorHandler(logger, hdlr.Delete)).Methods(http.MethodDelete)
 
 		s.HandleFunc("/{id}/data", withErrorHandler(logger, hdlr.Data)).Methods(http.MethodGet)
 
-		s.HandleFunc("/{id}/tags", withErrorHandler(logger, hdlr.UpdateTags)).Methods(http.MethodPut)
+		s.HandleFunc("/{id}/tags", withErrorHandler(logger, withMaxBodySize(maxBodySize, hdlr.UpdateTags))).Methods(http.MethodPut)
+
+		s.HandleFunc("/{id}/diff", withErrorHandler(logger, hdlr.Diff)).Methods(http.MethodGet)
+		s.HandleFunc("/{id}/revert", withErrorHandler(logger, withMaxBodySize(maxBodySize, hdlr.Revert))).Methods(http.MethodPost)
 	})
 	return hdlr
 }
 
 func (bh *BlobHandler) Find(rw http.ResponseWriter, req *http.Request) error {
-	vars := mux.Vars(req)
-	blb, err := bh.aggregateRepo.Find(req.Context(), blob.ID(vars["id"]))
+	blb, err := bh.findVersion(req)
 	if err != nil {
-		if platform.IsMissingAggregate(err) {
-			return notFoundError(err)
-		}
-		return internalServerError(err)
+		return err
+	}
+	if notModified(rw, req, blb) {
+		return nil
 	}
 
 	b := struct {
 		blob.ID       `json:"id"`
 		blob.BlobType `json:"blobType"`
-		Data          []byte `json:"data"`
-		Deleted       bool   `json:"deleted"`
-		Sequence      uint64 `json:"sequence"`
+		Data          []byte           `json:"data"`
+		Payload       *blob.PayloadRef `json:"payload,omitempty"`
+		Deleted       bool             `json:"deleted"`
+		Sequence      uint64           `json:"sequence"`
 		blob.Tags     `json:"tags"`
+		CreatedAt     time.Time `json:"createdAt"`
+		UpdatedAt     time.Time `json:"updatedAt"`
+		UpdatedBy     string    `json:"updatedBy,omitempty"`
 	}(blb)
 
 	return OkJSON(rw, b)
 }
 
+// findVersion finds the blob as it was at the atSequence or asOf (RFC 3339) query parameter, if present,
+// or the current blob.
+func (bh *BlobHandler) findVersion(req *http.Request) (blob.Blob, error) {
+	id := blob.ID(mux.Vars(req)["id"])
+	atSequence, asOf := req.URL.Query().Get("atSequence"), req.URL.Query().Get("asOf")
+
+	var blb blob.Blob
+	var err error
+	switch {
+	case atSequence != "" && asOf != "":
+		return blob.Blob{}, badRequestError(errors.New("only one of atSequence and asOf can be set"))
+	case atSequence != "":
+		sequence, parseErr := strconv.ParseUint(atSequence, 10, 64)
+		if parseErr != nil {
+			return blob.Blob{}, badRequestError(fmt.Errorf("invalid atSequence %q", atSequence))
+		}
+		blb, err = bh.aggregateRepo.FindAt(req.Context(), id, sequence)
+	case asOf != "":
+		t, parseErr := time.Parse(time.RFC3339, asOf)
+		if parseErr != nil {
+			return blob.Blob{}, badRequestError(fmt.Errorf("invalid asOf %q: %v", asOf, parseErr))
+		}
+		blb, err = bh.aggregateRepo.FindAsOf(req.Context(), id, t)
+	default:
+		blb, err = bh.aggregateRepo.Find(req.Context(), id)
+	}
+	if err != nil {
+		if platform.IsMissingAggregate(err) {
+			return blob.Blob{}, notFoundError(err)
+		}
+		return blob.Blob{}, internalServerError(err)
+	}
+	return blb, nil
+}
+
+// Diff returns what changed between the versions at the from and to sequences. With text=true the data of text
+// blobs is also diffed line by line.
+func (bh *BlobHandler) Diff(rw http.ResponseWriter, req *http.Request) error {
+	vars := mux.Vars(req)
+	if req.URL.Query().Get("from") == "" || req.URL.Query().Get("to") == "" {
+		return badRequestError(errors.New("from and to sequences should be set"))
+	}
+	from, err := queryUint(req, "from", 0)
+	if err != nil {
+		return badRequestError(err)
+	}
+	to, err := queryUint(req, "to", 0)
+	if err != nil {
+		return badRequestError(err)
+	}
+	textDiff := req.URL.Query().Get("text") == "true"
+
+	diff, err := bh.aggregateRepo.Diff(req.Context(), blob.ID(vars["id"]), from, to, textDiff)
+	if err != nil {
+		if platform.IsMissingAggregate(err) {
+			return notFoundError(err)
+		}
+		return internalServerError(err)
+	}
+	return OkJSON(rw, diff)
+}
+
 func (bh *BlobHandler) Create(rw http.ResponseWriter, req *http.Request) error {
 	vars := mux.Vars(req)
 	blobType := req.Header.Get("Content-Type")
@@ -67,11 +138,11 @@ func (bh *BlobHandler) Create(rw http.ResponseWriter, req *http.Request) error {
 	}
 	data, err := ioutil.ReadAll(req.Body)
 	if err != nil {
-		return notFoundError(err)
+		return readBodyError(err)
 	}
 
 	cmd := blob.CreateCommand(blob.ID(vars["id"]), blob.BlobType(blobType), data)
-	return bh.process(req.Context(), cmd, rw)
+	return bh.process(req, cmd, rw)
 }
 
 func (bh *BlobHandler) Update(rw http.ResponseWriter, req *http.Request) error {
@@ -82,7 +153,7 @@ func (bh *BlobHandler) Update(rw http.ResponseWriter, req *http.Request) error {
 		RestoreBlob bool   `json:"restoreBlob"`
 	}
 	if err := json.NewDecoder(req.Body).Decode(&updateReq); err != nil {
-		return handlerError{http.StatusBadRequest, fmt.Errorf("failed to decode response body: %v", err)}
+		return readBodyError(fmt.Errorf("failed to decode response body: %w", err))
 	}
 
 	var cmd blob.Command
@@ -91,28 +162,36 @@ func (bh *BlobHandler) Update(rw http.ResponseWriter, req *http.Request) error {
 	} else {
 		cmd = blob.UpdateCommand(blob.ID(vars["id"]), updateReq.UpdatedData, updateReq.ClearData)
 	}
-	return bh.process(req.Context(), cmd, rw)
+	return bh.process(req, cmd, rw)
 }
 
 func (bh *BlobHandler) Delete(rw http.ResponseWriter, req *http.Request) error {
 	vars := mux.Vars(req)
-	return bh.process(req.Context(), blob.DeleteCommand(blob.ID(vars["id"])), rw)
+	return bh.process(req, blob.DeleteCommand(blob.ID(vars["id"])), rw)
 }
 
+// Data serves the data of the blob, read from the PayloadStore if the blob refers to it, with http.ServeContent.
+// It handles Range, If-Range and the other conditional request headers using the blob ETag and the time of its
+// last event as Last-Modified.
 func (bh *BlobHandler) Data(rw http.ResponseWriter, req *http.Request) error {
-	vars := mux.Vars(req)
-	blb, err := bh.aggregateRepo.Find(req.Context(), blob.ID(vars["id"]))
+	blb, err := bh.findVersion(req)
 	if err != nil {
-		if platform.IsMissingAggregate(err) {
-			return notFoundError(err)
-		}
-		return internalServerError(err)
+		return err
 	}
 
 	if blb.Deleted {
 		return notFoundError(fmt.Errorf("blob %v is deleted", blb.ID))
 	}
-	return Ok(rw, blb.BlobType.String(), bytes.NewBuffer(blb.Data))
+	data, err := bh.aggregateRepo.OpenData(req.Context(), blb)
+	if err != nil {
+		return internalServerError(err)
+	}
+	defer data.Close()
+
+	rw.Header().Set("ETag", etag(blb))
+	rw.Header().Set("Content-Type", blb.BlobType.String())
+	http.ServeContent(rw, req, "", blb.UpdatedAt, data)
+	return nil
 }
 
 func (bh *BlobHandler) UpdateTags(rw http.ResponseWriter, req *http.Request) error {
@@ -122,23 +201,120 @@ func (bh *BlobHandler) UpdateTags(rw http.ResponseWriter, req *http.Request) err
 		Delete      []string  `json:"delete"`
 	}
 	if err := json.NewDecoder(req.Body).Decode(&tagReq); err != nil {
-		return handlerError{http.StatusBadRequest, fmt.Errorf("failed to decode response body: %v", err)}
+		return readBodyError(fmt.Errorf("failed to decode response body: %w", err))
 	}
 
 	cmd := blob.UpdateTagsCommand(blob.ID(vars["id"]), tagReq.AddOrUpdate, tagReq.Delete)
-	return bh.process(req.Context(), cmd, rw)
+	return bh.process(req, cmd, rw)
+}
+
+// Revert brings the blob back to its version at targetSequence with a RevertCommand.
+func (bh *BlobHandler) Revert(rw http.ResponseWriter, req *http.Request) error {
+	vars := mux.Vars(req)
+	var revertReq struct {
+		TargetSequence uint64 `json:"targetSequence"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&revertReq); err != nil {
+		return readBodyError(fmt.Errorf("failed to decode response body: %w", err))
+	}
+	return bh.process(req, blob.RevertCommand(blob.ID(vars["id"]), revertReq.TargetSequence), rw)
+}
+
+func (bh *BlobHandler) process(req *http.Request, cmd blob.Command, rw http.ResponseWriter) error {
+	return processCommand(bh.aggregateRepo, req, cmd, rw)
 }
 
-func (bh *BlobHandler) process(ctx context.Context, cmd blob.Command, rw http.ResponseWriter) error {
-	if _, err := bh.aggregateRepo.Process(ctx, cmd); err != nil {
+// processCommand processes the command and, with an If-Match header, only while the blob has one of the ETags
+// or, with If-Match: *, while the blob exists.
+func processCommand(aggregateRepo blob.AggregateRepository, req *http.Request, cmd blob.Command, rw http.ResponseWriter) error {
+	if ifMatch := strings.TrimSpace(req.Header.Get("If-Match")); ifMatch == "*" {
+		cmd = cmd.WithExistingAggregate()
+	} else if ifMatch != "" {
+		expectedVersions, err := parseIfMatch(ifMatch)
+		if err != nil {
+			return badRequestError(err)
+		}
+		if len(expectedVersions) == 0 {
+			return preconditionFailedError(fmt.Errorf("no ETag in If-Match %s can match blob %v", ifMatch, cmd.ID))
+		}
+		cmd = cmd.WithExpectedVersion(expectedVersions...)
+	}
+
+	blb, err := aggregateRepo.Process(req.Context(), cmd)
+	if err != nil {
 		if platform.IsMissingAggregate(err) {
 			return notFoundError(err)
 		}
 		if platform.CommandError(err) {
 			return badRequestError(err)
 		}
+		if platform.IsPreconditionFailed(err) {
+			return preconditionFailedError(err)
+		}
+		if platform.IsIdempotencyConflict(err) {
+			return unprocessableEntityError(err)
+		}
+		if platform.IsConcurrencyConflict(err) || platform.IsRetriesExhausted(err) {
+			return conflictError(err)
+		}
 		return internalServerError(err)
 	}
+	rw.Header().Set("ETag", etag(blb))
 	rw.WriteHeader(http.StatusNoContent)
 	return nil
 }
+
+// etag is the strong ETag of a version of the blob, which is its sequence.
+func etag(blb blob.Blob) string {
+	return fmt.Sprintf(`"%d"`, blb.Sequence)
+}
+
+// parseIfMatch returns the versions of the blob in the list of entity tags of an If-Match header as defined by
+// RFC 7232. If-Match uses the strong comparison, so weak ETags and strong ETags that are not a version of a blob
+// cannot match and are left out.
+func parseIfMatch(value string) ([]uint64, error) {
+	var versions []uint64
+	var tags int
+	for rest := value; ; {
+		// Empty list elements are allowed.
+		rest = strings.TrimLeft(rest, " \t,")
+		if rest == "" {
+			if tags == 0 {
+				return nil, fmt.Errorf("invalid If-Match %s; it should have at least one ETag", value)
+			}
+			return versions, nil
+		}
+		weak := strings.HasPrefix(rest, "W/")
+		rest = strings.TrimPrefix(rest, "W/")
+		if !strings.HasPrefix(rest, `"`) {
+			return nil, fmt.Errorf("invalid If-Match %s; it should be a list of quoted ETags", value)
+		}
+		end := strings.IndexByte(rest[1:], '"')
+		if end < 0 {
+			return nil, fmt.Errorf("invalid If-Match %s; an ETag is not terminated", value)
+		}
+		if version, err := strconv.ParseUint(rest[1:end+1], 10, 64); err == nil && !weak {
+			versions = append(versions, version)
+		}
+		tags++
+
+		rest = strings.TrimLeft(rest[end+2:], " \t")
+		if rest != "" && rest[0] != ',' {
+			return nil, fmt.Errorf("invalid If-Match %s; ETags should be separated by commas", value)
+		}
+	}
+}
+
+// notModified sets the ETag of the blob and writes a 304 response if it matches the If-None-Match header.
+func notModified(rw http.ResponseWriter, req *http.Request, blb blob.Blob) bool {
+	tag := etag(blb)
+	rw.Header().Set("ETag", tag)
+	for _, candidate := range strings.Split(req.Header.Get("If-None-Match"), ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == tag || candidate == "*" {
+			rw.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
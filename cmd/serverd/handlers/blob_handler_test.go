@@ -0,0 +1,160 @@
+package handlers
+
+import (
+	"context"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/venkssa/eventsourcing/internal/blob"
+)
+
+func TestParseIfMatch(t *testing.T) {
+	tests := map[string]struct {
+		Value            string
+		ExpectedVersions []uint64
+		ExpectedError    bool
+	}{
+		"strong ETag":                      {Value: `"1"`, ExpectedVersions: []uint64{1}},
+		"list of ETags":                    {Value: `"1", "2",W/"3"`, ExpectedVersions: []uint64{1, 2}},
+		"weak ETags never match":           {Value: `W/"1"`, ExpectedVersions: nil},
+		"ETags that are not versions":      {Value: `"abc", "a,b"`, ExpectedVersions: nil},
+		"empty list elements":              {Value: ` , "1",, "2" ,`, ExpectedVersions: []uint64{1, 2}},
+		"unquoted ETag is an error":        {Value: `1`, ExpectedError: true},
+		"unterminated ETag is an error":    {Value: `"1`, ExpectedError: true},
+		"ETags without commas is an error": {Value: `"1" "2"`, ExpectedError: true},
+		"list without ETags is an error":   {Value: `,`, ExpectedError: true},
+	}
+	for testName, data := range tests {
+		t.Run(testName, func(t *testing.T) {
+			versions, err := parseIfMatch(data.Value)
+			if (err != nil) != data.ExpectedError {
+				t.Fatalf("Expected an error %v but got '%v'", data.ExpectedError, err)
+			}
+			if !reflect.DeepEqual(versions, data.ExpectedVersions) {
+				t.Fatalf("Expected versions %v but got %v", data.ExpectedVersions, versions)
+			}
+		})
+	}
+}
+
+func TestBlobHandlerData(t *testing.T) {
+	ctx := context.Background()
+	store := blob.NewInMemoryEventStore()
+	repo := blob.NewAggregateRepository(store)
+	for _, cmd := range []blob.Command{
+		blob.CreateCommand("1", "text/plain", []byte("hello")),
+		blob.UpdateCommand("1", []byte("hello world"), false),
+	} {
+		if _, err := repo.Process(ctx, cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	events, err := store.Find(ctx, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lastModified := events[len(events)-1].RecordedAt.UTC().Format(http.TimeFormat)
+
+	router := mux.NewRouter()
+	NewBlobHandler(testLogger{t}, repo, 0).Register(router)
+	serve := func(path string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		for key, value := range headers {
+			req.Header.Set(key, value)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+	assertHeaders := func(rec *httptest.ResponseRecorder, expected map[string]string) {
+		t.Helper()
+		for key, value := range expected {
+			if actual := rec.Header().Get(key); actual != value {
+				t.Fatalf("Expected header %v to be %q but was %q", key, value, actual)
+			}
+		}
+	}
+
+	t.Run("all data", func(t *testing.T) {
+		rec := serve("/blob/1/data", nil)
+		if rec.Code != http.StatusOK || rec.Body.String() != "hello world" {
+			t.Fatalf("Expected 200 with all data but got %d: %s", rec.Code, rec.Body)
+		}
+		assertHeaders(rec, map[string]string{
+			"Content-Type":   "text/plain",
+			"Content-Length": "11",
+			"Accept-Ranges":  "bytes",
+			"ETag":           `"2"`,
+			"Last-Modified":  lastModified,
+		})
+	})
+
+	t.Run("earlier version", func(t *testing.T) {
+		rec := serve("/blob/1/data?atSequence=1", nil)
+		if rec.Code != http.StatusOK || rec.Body.String() != "hello" {
+			t.Fatalf("Expected 200 with the data of sequence 1 but got %d: %s", rec.Code, rec.Body)
+		}
+		assertHeaders(rec, map[string]string{"ETag": `"1"`, "Last-Modified": events[0].RecordedAt.UTC().Format(http.TimeFormat)})
+	})
+
+	t.Run("single range", func(t *testing.T) {
+		rec := serve("/blob/1/data", map[string]string{"Range": "bytes=6-"})
+		if rec.Code != http.StatusPartialContent || rec.Body.String() != "world" {
+			t.Fatalf("Expected 206 with the range but got %d: %s", rec.Code, rec.Body)
+		}
+		assertHeaders(rec, map[string]string{"Content-Range": "bytes 6-10/11", "Content-Length": "5"})
+	})
+
+	t.Run("multiple ranges", func(t *testing.T) {
+		rec := serve("/blob/1/data", map[string]string{"Range": "bytes=0-4,6-10"})
+		if rec.Code != http.StatusPartialContent {
+			t.Fatalf("Expected 206 but got %d: %s", rec.Code, rec.Body)
+		}
+		mediaType, params, err := mime.ParseMediaType(rec.Header().Get("Content-Type"))
+		if err != nil || mediaType != "multipart/byteranges" {
+			t.Fatalf("Expected multipart/byteranges but got %q, '%v'", rec.Header().Get("Content-Type"), err)
+		}
+		reader := multipart.NewReader(rec.Body, params["boundary"])
+		for _, expected := range []struct{ contentRange, data string }{{"bytes 0-4/11", "hello"}, {"bytes 6-10/11", "world"}} {
+			part, err := reader.NextPart()
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := ioutil.ReadAll(part)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if part.Header.Get("Content-Range") != expected.contentRange || string(data) != expected.data {
+				t.Fatalf("Expected part %v with %q but got %v with %q", expected.contentRange, expected.data, part.Header.Get("Content-Range"), data)
+			}
+		}
+	})
+
+	t.Run("If-Range with the current ETag", func(t *testing.T) {
+		rec := serve("/blob/1/data", map[string]string{"Range": "bytes=0-4", "If-Range": `"2"`})
+		if rec.Code != http.StatusPartialContent || rec.Body.String() != "hello" {
+			t.Fatalf("Expected 206 with the range but got %d: %s", rec.Code, rec.Body)
+		}
+	})
+
+	t.Run("If-Range with another ETag", func(t *testing.T) {
+		rec := serve("/blob/1/data", map[string]string{"Range": "bytes=0-4", "If-Range": `"1"`})
+		if rec.Code != http.StatusOK || rec.Body.String() != "hello world" {
+			t.Fatalf("Expected 200 with all data but got %d: %s", rec.Code, rec.Body)
+		}
+	})
+
+	t.Run("not modified", func(t *testing.T) {
+		rec := serve("/blob/1/data", map[string]string{"If-None-Match": `"2"`})
+		if rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+			t.Fatalf("Expected 304 without a body but got %d: %s", rec.Code, rec.Body)
+		}
+		assertHeaders(rec, map[string]string{"ETag": `"2"`})
+	})
+}
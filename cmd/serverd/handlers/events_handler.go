@@ -0,0 +1,369 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/venkssa/eventsourcing/internal/blob"
+	"github.com/venkssa/eventsourcing/internal/platform"
+	"github.com/venkssa/eventsourcing/internal/platform/log"
+)
+
+const (
+	sseKeepAliveInterval = 15 * time.Second
+
+	defaultHistoryLimit = 100
+	maxHistoryLimit     = 1000
+)
+
+// eventTypeNames are the event types of the events of the blob package as they are named by the API. They are kept
+// apart from the names in the EventRegistry, which are short codes that must never change in persisted events.
+var eventTypeNames = map[string]blob.Event{
+	"created":     blob.CreatedEvent{},
+	"dataUpdated": blob.DataUpdatedEvent{},
+	"tagsAdded":   blob.TagsAddedEvent{},
+	"tagsUpdated": blob.TagsUpdatedEvent{},
+	"tagsDeleted": blob.TagsDeletedEvent{},
+	"deleted":     blob.DeletedEvent{},
+	"restored":    blob.RestoredEvent{},
+}
+
+type EventsHandler struct {
+	HandlerRegisterFunc
+	logger log.Logger
+	store  blob.EventStore
+}
+
+func NewEventsHandler(logger log.Logger, store blob.EventStore) HandlerRegisterer {
+	hdlr := &EventsHandler{logger: logger, store: store}
+	hdlr.HandlerRegisterFunc = HandlerRegisterFunc(func(muxRouter *mux.Router) {
+		muxRouter.HandleFunc("/events", withErrorHandler(logger, hdlr.Stream)).Methods(http.MethodGet)
+		muxRouter.HandleFunc("/blob/{id}/events/stream", withErrorHandler(logger, hdlr.Stream)).Methods(http.MethodGet)
+		muxRouter.HandleFunc("/blob/{id}/history", withErrorHandler(logger, hdlr.History)).Methods(http.MethodGet)
+	})
+	return hdlr
+}
+
+// Stream streams persisted events as Server-Sent Events with the event position as the event id.
+// Without a Last-Event-ID header only events persisted after the request are streamed. The stream of a blob catches
+// up with the events of the blob and only follows all events for the events persisted after the request.
+// The type and tag query parameters, which can be repeated, only stream events of the given event types, such as
+// created or tagsUpdated, and events that change the given tags; a tag is either key or key:value.
+func (eh *EventsHandler) Stream(rw http.ResponseWriter, req *http.Request) error {
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		return internalServerError(errors.New("streaming is not supported"))
+	}
+
+	from, err := eh.streamStart(req)
+	if err != nil {
+		return err
+	}
+	id := blob.ID(mux.Vars(req)["id"])
+	filter, err := newEventFilter(id, req)
+	if err != nil {
+		return badRequestError(err)
+	}
+
+	ctx := req.Context()
+	var caughtUp blob.EventWithMetadataSlice
+	if id != "" {
+		if caughtUp, from, err = eh.catchUp(ctx, id, from); err != nil {
+			return internalServerError(err)
+		}
+	}
+	subscription, err := blob.Subscribe(ctx, eh.store, blob.SubscriptionOptions{FromPosition: from, Filter: filter})
+	if err != nil {
+		return internalServerError(err)
+	}
+	defer subscription.Close()
+
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.Header().Set("Connection", "keep-alive")
+	rw.WriteHeader(http.StatusOK)
+	for _, event := range caughtUp {
+		if !filter(event) {
+			continue
+		}
+		if err := writeServerSentEvent(rw, event); err != nil {
+			eh.logger.Debug(err)
+			return nil
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(sseKeepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case event, ok := <-subscription.Events():
+			if !ok {
+				if err := subscription.Err(); err != nil {
+					eh.logger.Info(err)
+				}
+				return nil
+			}
+			if err := writeServerSentEvent(rw, event); err != nil {
+				eh.logger.Debug(err)
+				return nil
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(rw, ": keep-alive\n\n"); err != nil {
+				return nil
+			}
+		case <-ctx.Done():
+			return nil
+		}
+		flusher.Flush()
+	}
+}
+
+// History lists the events of a blob in sequence order, starting with the event at the from query parameter.
+// At most limit events are listed; nextSequence is the from of the next page and is left out on the last page.
+// The type and tag query parameters filter the events as they do for Stream.
+func (eh *EventsHandler) History(rw http.ResponseWriter, req *http.Request) error {
+	id := blob.ID(mux.Vars(req)["id"])
+	from, err := queryUint(req, "from", 1)
+	if err != nil {
+		return badRequestError(err)
+	}
+	limit, err := queryUint(req, "limit", defaultHistoryLimit)
+	if err != nil {
+		return badRequestError(err)
+	}
+	if limit == 0 || limit > maxHistoryLimit {
+		return badRequestError(fmt.Errorf("limit must be between 1 and %d", maxHistoryLimit))
+	}
+	filter, err := newEventFilter(id, req)
+	if err != nil {
+		return badRequestError(err)
+	}
+
+	// Read a page at a time until one event more than the limit matches so we know whether there is a next page.
+	// The event store returns a missing aggregate for a blob without events, whatever the range, so a missing
+	// blob is found on the first read.
+	var matched blob.EventWithMetadataSlice
+	for sequence := from; uint64(len(matched)) <= limit; {
+		events, err := eh.store.FindRange(req.Context(), id, sequence, sequence+limit)
+		if err != nil {
+			if platform.IsMissingAggregate(err) {
+				return notFoundError(err)
+			}
+			return internalServerError(err)
+		}
+		if len(events) == 0 {
+			break
+		}
+		for _, event := range events {
+			if filter(event) {
+				matched = append(matched, event)
+			}
+		}
+		sequence = events[len(events)-1].Sequence + 1
+	}
+
+	resp := struct {
+		Events       []eventResponse `json:"events"`
+		NextSequence uint64          `json:"nextSequence,omitempty"`
+	}{Events: make([]eventResponse, 0, len(matched))}
+	if uint64(len(matched)) > limit {
+		resp.NextSequence = matched[limit].Sequence
+		matched = matched[:limit]
+	}
+	for _, event := range matched {
+		er, err := newEventResponse(event)
+		if err != nil {
+			return internalServerError(err)
+		}
+		resp.Events = append(resp.Events, er)
+	}
+	return OkJSON(rw, resp)
+}
+
+func queryUint(req *http.Request, name string, defaultValue uint64) (uint64, error) {
+	value := req.URL.Query().Get(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+	n, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q", name, value)
+	}
+	return n, nil
+}
+
+// catchUp returns the events of the blob persisted so far from position from on, read from the events of the blob
+// instead of all events, and the position to follow all events from once they are streamed.
+func (eh *EventsHandler) catchUp(ctx context.Context, id blob.ID, from uint64) (blob.EventWithMetadataSlice, uint64, error) {
+	last, err := eh.store.LastPosition(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	if from > last {
+		return nil, from, nil
+	}
+	events, err := eh.store.FindFrom(ctx, id, 1)
+	if err != nil && !platform.IsMissingAggregate(err) {
+		return nil, 0, err
+	}
+	var caughtUp blob.EventWithMetadataSlice
+	for _, event := range events {
+		if event.Position >= from && event.Position <= last {
+			caughtUp = append(caughtUp, event)
+		}
+	}
+	return caughtUp, last + 1, nil
+}
+
+func (eh *EventsHandler) streamStart(req *http.Request) (uint64, error) {
+	if lastEventID := req.Header.Get("Last-Event-ID"); lastEventID != "" {
+		position, err := strconv.ParseUint(lastEventID, 10, 64)
+		if err != nil {
+			return 0, badRequestError(fmt.Errorf("invalid Last-Event-ID %q", lastEventID))
+		}
+		return position + 1, nil
+	}
+	position, err := eh.store.LastPosition(req.Context())
+	if err != nil {
+		return 0, internalServerError(err)
+	}
+	return position + 1, nil
+}
+
+func newEventFilter(id blob.ID, req *http.Request) (func(blob.EventWithMetadata) bool, error) {
+	eventTypes := make(map[string]bool)
+	for _, eventType := range req.URL.Query()["type"] {
+		if err := checkEventTypeName(eventType); err != nil {
+			return nil, err
+		}
+		eventTypes[eventType] = true
+	}
+	tags := req.URL.Query()["tag"]
+
+	return func(event blob.EventWithMetadata) bool {
+		if id != "" && event.ID != id {
+			return false
+		}
+		if len(eventTypes) != 0 {
+			eventType, err := eventTypeName(event.Event)
+			if err != nil || !eventTypes[eventType] {
+				return false
+			}
+		}
+		if len(tags) != 0 {
+			return changesAnyTag(blob.ChangedTags(event.Event), tags)
+		}
+		return true
+	}, nil
+}
+
+// eventTypeName returns the name of the event type of event in eventTypeNames or, for events of other packages, the
+// name it is registered with.
+func eventTypeName(event blob.Event) (string, error) {
+	for name, prototype := range eventTypeNames {
+		if reflect.TypeOf(event) == reflect.TypeOf(prototype) {
+			return name, nil
+		}
+	}
+	eventType, err := blob.DefaultEventRegistry.Lookup(event)
+	if err != nil {
+		return "", err
+	}
+	return eventType.Name, nil
+}
+
+// checkEventTypeName returns an error unless name is returned by eventTypeName for some event.
+func checkEventTypeName(name string) error {
+	if _, ok := eventTypeNames[name]; ok {
+		return nil
+	}
+	eventType, err := blob.DefaultEventRegistry.LookupName(name)
+	if err != nil {
+		return err
+	}
+	for _, prototype := range eventTypeNames {
+		if registered, err := blob.DefaultEventRegistry.Lookup(prototype); err == nil && registered.Name == eventType.Name {
+			return fmt.Errorf("unknown event type %q", name)
+		}
+	}
+	return nil
+}
+
+func changesAnyTag(changed blob.Tags, tags []string) bool {
+	for _, tag := range tags {
+		key, value, hasValue := strings.Cut(tag, ":")
+		changedValue, ok := changed[key]
+		if ok && (!hasValue || changedValue == value) {
+			return true
+		}
+	}
+	return false
+}
+
+type eventResponse struct {
+	blob.ID   `json:"id"`
+	Sequence  uint64                `json:"sequence"`
+	Position  uint64                `json:"position"`
+	EventType string                `json:"eventType"`
+	Payload   json.RawMessage       `json:"payload"`
+	Metadata  eventMetadataResponse `json:"metadata"`
+}
+
+// eventMetadataResponse is the blob.Metadata published with events. The idempotency key and fingerprint are left
+// out as they are only meant for the client that sent the command and the AggregateRepository.
+type eventMetadataResponse struct {
+	EventID       string            `json:"eventId,omitempty"`
+	RecordedAt    time.Time         `json:"recordedAt"`
+	CorrelationID string            `json:"correlationId,omitempty"`
+	CausationID   string            `json:"causationId,omitempty"`
+	Actor         string            `json:"actor,omitempty"`
+	Headers       map[string]string `json:"headers,omitempty"`
+}
+
+func newEventResponse(event blob.EventWithMetadata) (eventResponse, error) {
+	eventType, err := eventTypeName(event.Event)
+	if err != nil {
+		return eventResponse{}, err
+	}
+	payload, err := json.Marshal(event.Event)
+	if err != nil {
+		return eventResponse{}, err
+	}
+	return eventResponse{
+		ID:        event.ID,
+		Sequence:  event.Sequence,
+		Position:  event.Position,
+		EventType: eventType,
+		Payload:   payload,
+		Metadata: eventMetadataResponse{
+			EventID:       event.EventID,
+			RecordedAt:    event.RecordedAt,
+			CorrelationID: event.CorrelationID,
+			CausationID:   event.CausationID,
+			Actor:         event.Actor,
+			Headers:       event.Headers,
+		},
+	}, nil
+}
+
+func writeServerSentEvent(rw http.ResponseWriter, event blob.EventWithMetadata) error {
+	resp, err := newEventResponse(event)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(rw, "id: %d\nevent: %s\ndata: %s\n\n", event.Position, resp.EventType, data)
+	return err
+}
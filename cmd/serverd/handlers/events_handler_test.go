@@ -0,0 +1,429 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/venkssa/eventsourcing/internal/blob"
+)
+
+type testLogger struct {
+	t *testing.T
+}
+
+func (l testLogger) Info(v ...interface{}) {
+	l.t.Log(v...)
+}
+
+func (l testLogger) Debug(v ...interface{}) {
+	l.t.Log(v...)
+}
+
+// newEventsRouter returns a router with an EventsHandler for the store of newEventsStore.
+func newEventsRouter(t *testing.T) *mux.Router {
+	router := mux.NewRouter()
+	NewEventsHandler(testLogger{t}, newEventsStore(t)).Register(router)
+	return router
+}
+
+// newEventsStore returns a store with the events of blob 1 at positions 1 to 5 and the event of blob 2 at
+// position 6.
+func newEventsStore(t *testing.T) *blob.InMemoryEventStore {
+	ctx := context.Background()
+	store := blob.NewInMemoryEventStore()
+	repo := blob.NewAggregateRepository(store)
+	for _, cmd := range []blob.Command{
+		blob.CreateCommand("1", "text/plain", []byte("one")),
+		blob.UpdateTagsCommand("1", blob.Tags{"a": "1"}, nil),
+		blob.UpdateCommand("1", []byte("two"), false),
+		blob.UpdateTagsCommand("1", blob.Tags{"a": "2"}, nil),
+		blob.DeleteCommand("1"),
+		blob.CreateCommand("2", "text/plain", []byte("three")),
+	} {
+		if _, err := repo.Process(ctx, cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return store
+}
+
+func TestEventsHandlerHistory(t *testing.T) {
+	router := newEventsRouter(t)
+
+	tests := map[string]struct {
+		Query                string
+		ExpectedStatus       int
+		ExpectedTypes        []string
+		ExpectedSequences    []uint64
+		ExpectedNextSequence uint64
+	}{
+		"all events": {
+			ExpectedStatus:    http.StatusOK,
+			ExpectedTypes:     []string{"created", "tagsAdded", "dataUpdated", "tagsUpdated", "deleted"},
+			ExpectedSequences: []uint64{1, 2, 3, 4, 5},
+		},
+		"first page": {
+			Query:                "limit=2",
+			ExpectedStatus:       http.StatusOK,
+			ExpectedTypes:        []string{"created", "tagsAdded"},
+			ExpectedSequences:    []uint64{1, 2},
+			ExpectedNextSequence: 3,
+		},
+		"last page": {
+			Query:             "from=4&limit=2",
+			ExpectedStatus:    http.StatusOK,
+			ExpectedTypes:     []string{"tagsUpdated", "deleted"},
+			ExpectedSequences: []uint64{4, 5},
+		},
+		"page of filtered events": {
+			Query:                "type=tagsAdded&type=tagsUpdated&type=deleted&limit=2",
+			ExpectedStatus:       http.StatusOK,
+			ExpectedTypes:        []string{"tagsAdded", "tagsUpdated"},
+			ExpectedSequences:    []uint64{2, 4},
+			ExpectedNextSequence: 5,
+		},
+		"events changing a tag value": {
+			Query:             "tag=a:2",
+			ExpectedStatus:    http.StatusOK,
+			ExpectedTypes:     []string{"tagsUpdated"},
+			ExpectedSequences: []uint64{4},
+		},
+		"events changing a tag": {
+			Query:             "tag=a",
+			ExpectedStatus:    http.StatusOK,
+			ExpectedTypes:     []string{"tagsAdded", "tagsUpdated"},
+			ExpectedSequences: []uint64{2, 4},
+		},
+		"no matching events": {
+			Query:          "type=restored",
+			ExpectedStatus: http.StatusOK,
+		},
+		"unknown event type": {
+			Query:          "type=unknown",
+			ExpectedStatus: http.StatusBadRequest,
+		},
+		"registered name of an event type": {
+			Query:          "type=CE",
+			ExpectedStatus: http.StatusBadRequest,
+		},
+		"limit over the maximum": {
+			Query:          "limit=1001",
+			ExpectedStatus: http.StatusBadRequest,
+		},
+		"invalid from": {
+			Query:          "from=first",
+			ExpectedStatus: http.StatusBadRequest,
+		},
+	}
+	for testName, data := range tests {
+		t.Run(testName, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/blob/1/history?"+data.Query, nil))
+			if rec.Code != data.ExpectedStatus {
+				t.Fatalf("Expected status %d but was %d: %s", data.ExpectedStatus, rec.Code, rec.Body)
+			}
+			if rec.Code != http.StatusOK {
+				return
+			}
+
+			var resp struct {
+				Events []struct {
+					ID        string `json:"id"`
+					Sequence  uint64 `json:"sequence"`
+					EventType string `json:"eventType"`
+				} `json:"events"`
+				NextSequence uint64 `json:"nextSequence"`
+			}
+			if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+			var types []string
+			var sequences []uint64
+			for _, event := range resp.Events {
+				if event.ID != "1" {
+					t.Fatalf("Expected only events of blob 1 but got an event of %v", event.ID)
+				}
+				types = append(types, event.EventType)
+				sequences = append(sequences, event.Sequence)
+			}
+			if !reflect.DeepEqual(types, data.ExpectedTypes) || !reflect.DeepEqual(sequences, data.ExpectedSequences) {
+				t.Fatalf("Expected events %v at %v but got %v at %v", data.ExpectedTypes, data.ExpectedSequences, types, sequences)
+			}
+			if resp.NextSequence != data.ExpectedNextSequence {
+				t.Fatalf("Expected next sequence %d but was %d", data.ExpectedNextSequence, resp.NextSequence)
+			}
+		})
+	}
+}
+
+func TestEventsHandlerHistoryOfMissingBlob(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fileSystemStore, err := blob.NewLocalFileSystemEventStore(dir, blob.FsyncNever)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stores := map[string]blob.EventStore{
+		"InMemoryEventStore":        blob.NewInMemoryEventStore(),
+		"LocalFileSystemEventStore": fileSystemStore,
+	}
+
+	for storeName, store := range stores {
+		t.Run(storeName, func(t *testing.T) {
+			if _, err := blob.NewAggregateRepository(store).Process(context.Background(), blob.CreateCommand("1", "text/plain", []byte("one"))); err != nil {
+				t.Fatal(err)
+			}
+			router := mux.NewRouter()
+			NewEventsHandler(testLogger{t}, store).Register(router)
+
+			for path, expectedStatus := range map[string]int{
+				"/blob/2/history":        http.StatusNotFound,
+				"/blob/2/history?from=5": http.StatusNotFound,
+				"/blob/1/history?from=5": http.StatusOK,
+			} {
+				rec := httptest.NewRecorder()
+				router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+				if rec.Code != expectedStatus {
+					t.Fatalf("Expected status %d for %v but was %d: %s", expectedStatus, path, rec.Code, rec.Body)
+				}
+			}
+		})
+	}
+}
+
+func TestEventsHandlerLeavesOutIdempotencyMetadata(t *testing.T) {
+	store := blob.NewInMemoryEventStore()
+	ctx := blob.WithMetadata(context.Background(), blob.Metadata{Actor: "alice", IdempotencyKey: "retry-1"})
+	if _, err := blob.NewAggregateRepository(store).Process(ctx, blob.CreateCommand("1", "text/plain", []byte("one"))); err != nil {
+		t.Fatal(err)
+	}
+	router := mux.NewRouter()
+	NewEventsHandler(testLogger{t}, store).Register(router)
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/blob/1/history", nil))
+	var resp struct {
+		Events []struct {
+			Metadata map[string]interface{} `json:"metadata"`
+		} `json:"events"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Events) != 1 {
+		t.Fatalf("Expected 1 event but got %v", resp.Events)
+	}
+	metadata := resp.Events[0].Metadata
+	if metadata["actor"] != "alice" || metadata["eventId"] == nil || metadata["recordedAt"] == nil {
+		t.Fatalf("Expected the metadata of the event but got %v", metadata)
+	}
+	for _, key := range []string{"idempotencyKey", "idempotencyFingerprint"} {
+		if _, ok := metadata[key]; ok {
+			t.Fatalf("Expected %v to be left out of the metadata but got %v", key, metadata)
+		}
+	}
+}
+
+func TestEventsHandlerStream(t *testing.T) {
+	server := httptest.NewServer(newEventsRouter(t))
+	defer server.Close()
+
+	tests := map[string]struct {
+		Path           string
+		LastEventID    string
+		ExpectedStatus int
+		// ExpectedEvents are the id and event fields of the first events streamed.
+		ExpectedEvents []string
+	}{
+		"all events": {
+			Path:           "/events",
+			LastEventID:    "0",
+			ExpectedStatus: http.StatusOK,
+			ExpectedEvents: []string{"1 created", "2 tagsAdded", "3 dataUpdated", "4 tagsUpdated", "5 deleted", "6 created"},
+		},
+		"events after the Last-Event-ID": {
+			Path:           "/events",
+			LastEventID:    "4",
+			ExpectedStatus: http.StatusOK,
+			ExpectedEvents: []string{"5 deleted", "6 created"},
+		},
+		"events of a type": {
+			Path:           "/events?type=created",
+			LastEventID:    "0",
+			ExpectedStatus: http.StatusOK,
+			ExpectedEvents: []string{"1 created", "6 created"},
+		},
+		"events of a blob after the Last-Event-ID": {
+			Path:           "/blob/1/events/stream",
+			LastEventID:    "2",
+			ExpectedStatus: http.StatusOK,
+			ExpectedEvents: []string{"3 dataUpdated", "4 tagsUpdated", "5 deleted"},
+		},
+		"events of a blob changing a tag": {
+			Path:           "/blob/1/events/stream?tag=a",
+			LastEventID:    "0",
+			ExpectedStatus: http.StatusOK,
+			ExpectedEvents: []string{"2 tagsAdded", "4 tagsUpdated"},
+		},
+		"invalid Last-Event-ID": {
+			Path:           "/events",
+			LastEventID:    "last",
+			ExpectedStatus: http.StatusBadRequest,
+		},
+		"unknown event type": {
+			Path:           "/events?type=TAE",
+			LastEventID:    "0",
+			ExpectedStatus: http.StatusBadRequest,
+		},
+	}
+	for testName, data := range tests {
+		t.Run(testName, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+data.Path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Last-Event-ID", data.LastEventID)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != data.ExpectedStatus {
+				t.Fatalf("Expected status %d but was %d", data.ExpectedStatus, resp.StatusCode)
+			}
+			if resp.StatusCode != http.StatusOK {
+				return
+			}
+			if contentType := resp.Header.Get("Content-Type"); contentType != "text/event-stream" {
+				t.Fatalf("Expected content type text/event-stream but was %q", contentType)
+			}
+
+			var events []string
+			var id string
+			scanner := bufio.NewScanner(resp.Body)
+			for len(events) < len(data.ExpectedEvents) && scanner.Scan() {
+				field, value, _ := strings.Cut(scanner.Text(), ": ")
+				switch field {
+				case "id":
+					id = value
+				case "event":
+					events = append(events, id+" "+value)
+				case "data":
+					var event eventResponse
+					if err := json.Unmarshal([]byte(value), &event); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			if err := scanner.Err(); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(events, data.ExpectedEvents) {
+				t.Fatalf("Expected events %v but got %v", data.ExpectedEvents, events)
+			}
+		})
+	}
+}
+
+func TestCheckEventTypeName(t *testing.T) {
+	for name := range eventTypeNames {
+		if err := checkEventTypeName(name); err != nil {
+			t.Fatalf("Expected %q to be an event type but got '%v'", name, err)
+		}
+		eventType, err := eventTypeName(eventTypeNames[name])
+		if err != nil || eventType != name {
+			t.Fatalf("Expected the event type of %T to be %q but was %q (%v)", eventTypeNames[name], name, eventType, err)
+		}
+		registered, err := blob.DefaultEventRegistry.Lookup(eventTypeNames[name])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := checkEventTypeName(registered.Name); err == nil {
+			t.Fatalf("Expected the registered name %q of %q not to be an event type", registered.Name, name)
+		}
+	}
+}
+
+// readAllEventStore records the positions ReadAll reads from.
+type readAllEventStore struct {
+	blob.EventStore
+	mux           *sync.Mutex
+	fromPositions []uint64
+}
+
+func (r *readAllEventStore) ReadAll(ctx context.Context, fromPosition uint64, limit int) (blob.EventWithMetadataSlice, error) {
+	r.mux.Lock()
+	r.fromPositions = append(r.fromPositions, fromPosition)
+	r.mux.Unlock()
+	return r.EventStore.ReadAll(ctx, fromPosition, limit)
+}
+
+func TestEventsHandlerStreamOfBlobCatchesUpFromItsEvents(t *testing.T) {
+	store := &readAllEventStore{EventStore: newEventsStore(t), mux: new(sync.Mutex)}
+	router := mux.NewRouter()
+	NewEventsHandler(testLogger{t}, store).Register(router)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/blob/1/events/stream", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Last-Event-ID", "3")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	ids := make(chan string, 10)
+	go func() {
+		defer close(ids)
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if id := strings.TrimPrefix(scanner.Text(), "id: "); id != scanner.Text() {
+				ids <- id
+			}
+		}
+	}()
+	for _, expected := range []string{"4", "5"} {
+		if id := <-ids; id != expected {
+			t.Fatalf("Expected event %v but got %v", expected, id)
+		}
+	}
+
+	repo := blob.NewAggregateRepository(store)
+	for _, cmd := range []blob.Command{blob.DeleteCommand("2"), blob.RestoreCommand("1")} {
+		if _, err := repo.Process(context.Background(), cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if id := <-ids; id != "8" {
+		t.Fatalf("Expected the live event 8 of the blob but got %v", id)
+	}
+
+	store.mux.Lock()
+	defer store.mux.Unlock()
+	for _, fromPosition := range store.fromPositions {
+		if fromPosition < 7 {
+			t.Fatalf("Expected all events to be read from after the catch up but got reads from %v", store.fromPositions)
+		}
+	}
+}
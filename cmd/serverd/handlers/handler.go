@@ -7,9 +7,11 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
 
 	"github.com/gorilla/mux"
 	perrors "github.com/pkg/errors"
+	"github.com/venkssa/eventsourcing/internal/blob"
 	"github.com/venkssa/eventsourcing/internal/platform/log"
 )
 
@@ -32,6 +34,7 @@ func NotFoundHandler(logger log.Logger) http.HandlerFunc {
 func withErrorHandler(logger log.Logger, fn func(http.ResponseWriter, *http.Request) error) http.HandlerFunc {
 	return func(rw http.ResponseWriter, req *http.Request) {
 		rw.Header().Set("Access-Control-Allow-Origin", "*")
+		req = withRequestMetadata(rw, req)
 		err := fn(rw, req)
 		if err == nil {
 			return
@@ -45,6 +48,44 @@ func withErrorHandler(logger log.Logger, fn func(http.ResponseWriter, *http.Requ
 	}
 }
 
+// withMaxBodySize limits the request body to maxBodySize bytes, unless maxBodySize is 0.
+func withMaxBodySize(maxBodySize int64, fn func(http.ResponseWriter, *http.Request) error) func(http.ResponseWriter, *http.Request) error {
+	return func(rw http.ResponseWriter, req *http.Request) error {
+		if maxBodySize > 0 {
+			req.Body = http.MaxBytesReader(rw, req.Body, maxBodySize)
+		}
+		return fn(rw, req)
+	}
+}
+
+const eventHeaderPrefix = "X-Event-"
+
+// withRequestMetadata adds the X-Correlation-ID, X-Causation-ID, X-Actor, Idempotency-Key and X-Event-* request
+// headers to the request context so they are recorded on the events generated by the request. The correlation ID
+// is echoed back in the response. A retried request with the same Idempotency-Key returns the outcome of the
+// request that generated the events instead of processing the command again; a different request reusing the key
+// is rejected with 422.
+func withRequestMetadata(rw http.ResponseWriter, req *http.Request) *http.Request {
+	md := blob.Metadata{
+		CorrelationID:  req.Header.Get("X-Correlation-ID"),
+		CausationID:    req.Header.Get("X-Causation-ID"),
+		Actor:          req.Header.Get("X-Actor"),
+		IdempotencyKey: req.Header.Get("Idempotency-Key"),
+	}
+	for name, values := range req.Header {
+		if strings.HasPrefix(name, eventHeaderPrefix) && len(name) > len(eventHeaderPrefix) && len(values) != 0 {
+			if md.Headers == nil {
+				md.Headers = make(map[string]string)
+			}
+			md.Headers[strings.ToLower(strings.TrimPrefix(name, eventHeaderPrefix))] = values[0]
+		}
+	}
+	if md.CorrelationID != "" {
+		rw.Header().Set("X-Correlation-ID", md.CorrelationID)
+	}
+	return req.WithContext(blob.WithMetadata(req.Context(), md))
+}
+
 func Ok(rw http.ResponseWriter, contentType string, data io.Reader) error {
 	rw.Header().Set("Content-Type", contentType)
 	rw.WriteHeader(http.StatusOK)
@@ -79,6 +120,28 @@ func notFoundError(err error) handlerError {
 	return handlerError{Status: http.StatusNotFound, error: err}
 }
 
+func conflictError(err error) handlerError {
+	return handlerError{Status: http.StatusConflict, error: err}
+}
+
+// readBodyError is a 413 error if the request body is larger than allowed by withMaxBodySize and a 400 error
+// otherwise.
+func readBodyError(err error) handlerError {
+	var maxBytesError *http.MaxBytesError
+	if errors.As(err, &maxBytesError) {
+		return handlerError{Status: http.StatusRequestEntityTooLarge, error: err}
+	}
+	return badRequestError(err)
+}
+
+func preconditionFailedError(err error) handlerError {
+	return handlerError{Status: http.StatusPreconditionFailed, error: err}
+}
+
+func unprocessableEntityError(err error) handlerError {
+	return handlerError{Status: http.StatusUnprocessableEntity, error: err}
+}
+
 func (e handlerError) Write(logger log.Logger, rw http.ResponseWriter) {
 	if e.Status >= 500 {
 		logger.Info(e.error)
@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/venkssa/eventsourcing/internal/blob"
+	"github.com/venkssa/eventsourcing/internal/platform"
+	"github.com/venkssa/eventsourcing/internal/platform/log"
+	"github.com/venkssa/eventsourcing/internal/tagquery"
+)
+
+type ListHandler struct {
+	HandlerRegisterFunc
+	index *blob.BlobIndex
+}
+
+func NewListHandler(logger log.Logger, index *blob.BlobIndex) HandlerRegisterer {
+	hdlr := &ListHandler{index: index}
+	hdlr.HandlerRegisterFunc = HandlerRegisterFunc(func(muxRouter *mux.Router) {
+		muxRouter.HandleFunc("/blob", withErrorHandler(logger, hdlr.List)).Methods(http.MethodGet)
+	})
+	return hdlr
+}
+
+// List lists blobs ordered by ID from the BlobIndex, so recently processed commands may not be reflected yet.
+// The tag query parameter, which can be repeated, is either key or key:value. deleted is true, false or any and
+// is false by default. q is a tag query such as env=prod AND NOT has(archived), see package tagquery. cursor is
+// the nextCursor of the previous page and limit the size of a page.
+func (lh *ListHandler) List(rw http.ResponseWriter, req *http.Request) error {
+	params := req.URL.Query()
+	notDeleted := false
+	query := blob.BlobQuery{
+		BlobType: blob.BlobType(params.Get("type")),
+		Deleted:  &notDeleted,
+		Cursor:   params.Get("cursor"),
+	}
+	for _, tag := range params["tag"] {
+		key, value, hasValue := strings.Cut(tag, ":")
+		query.Tags = append(query.Tags, blob.TagFilter{Key: key, Value: value, HasValue: hasValue})
+	}
+	if q := params.Get("q"); q != "" {
+		expr, err := tagquery.Parse(q)
+		if err != nil {
+			return badRequestError(err)
+		}
+		query.TagQuery = expr
+	}
+	switch deleted := params.Get("deleted"); deleted {
+	case "", "false":
+	case "true":
+		query.Deleted = new(bool)
+		*query.Deleted = true
+	case "any":
+		query.Deleted = nil
+	default:
+		return badRequestError(fmt.Errorf("invalid deleted %q; should be true, false or any", deleted))
+	}
+	if limit := params.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil {
+			return badRequestError(fmt.Errorf("invalid limit %q", limit))
+		}
+		query.Limit = n
+	}
+
+	page, err := lh.index.Query(req.Context(), query)
+	if err != nil {
+		if platform.CommandError(err) {
+			return badRequestError(err)
+		}
+		return internalServerError(err)
+	}
+	return OkJSON(rw, page)
+}
@@ -0,0 +1,55 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/venkssa/eventsourcing/internal/blob"
+	"github.com/venkssa/eventsourcing/internal/platform"
+	"github.com/venkssa/eventsourcing/internal/platform/log"
+)
+
+type SearchHandler struct {
+	HandlerRegisterFunc
+	index *blob.SearchIndex
+}
+
+func NewSearchHandler(logger log.Logger, index *blob.SearchIndex) HandlerRegisterer {
+	hdlr := &SearchHandler{index: index}
+	hdlr.HandlerRegisterFunc = HandlerRegisterFunc(func(muxRouter *mux.Router) {
+		muxRouter.HandleFunc("/search", withErrorHandler(logger, hdlr.Search)).Methods(http.MethodGet)
+	})
+	return hdlr
+}
+
+// Search finds textual blobs whose data matches every term, "quoted phrase" and prefix* of the q query parameter,
+// best matches first. The SearchIndex is a projection, so recently processed commands may not be reflected yet.
+func (sh *SearchHandler) Search(rw http.ResponseWriter, req *http.Request) error {
+	params := req.URL.Query()
+	q := params.Get("q")
+	if q == "" {
+		return badRequestError(errors.New("q should not be empty"))
+	}
+	var limit int
+	if l := params.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil {
+			return badRequestError(fmt.Errorf("invalid limit %q", l))
+		}
+		limit = n
+	}
+
+	results, err := sh.index.Search(req.Context(), q, limit)
+	if err != nil {
+		if platform.CommandError(err) {
+			return badRequestError(err)
+		}
+		return internalServerError(err)
+	}
+	return OkJSON(rw, struct {
+		Results []blob.SearchResult `json:"results"`
+	}{results})
+}
@@ -0,0 +1,123 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/venkssa/eventsourcing/internal/blob"
+	"github.com/venkssa/eventsourcing/internal/platform"
+	"github.com/venkssa/eventsourcing/internal/platform/log"
+)
+
+type UploadHandler struct {
+	HandlerRegisterFunc
+	logger        log.Logger
+	aggregateRepo blob.AggregateRepository
+	uploads       *blob.LocalFileSystemUploadStore
+	payloads      blob.PayloadStore
+}
+
+// NewUploadHandler registers the routes to upload the data of a blob in parts of at most maxPartSize bytes.
+// Completing an upload creates the blob or updates its data with the assembled payload in payloads.
+func NewUploadHandler(logger log.Logger, aggregateRepo blob.AggregateRepository, uploads *blob.LocalFileSystemUploadStore,
+	payloads blob.PayloadStore, maxPartSize int64) HandlerRegisterer {
+	hdlr := &UploadHandler{logger: logger, aggregateRepo: aggregateRepo, uploads: uploads, payloads: payloads}
+	hdlr.HandlerRegisterFunc = HandlerRegisterFunc(func(muxRouter *mux.Router) {
+		s := muxRouter.PathPrefix("/blob/{id}/uploads").Subrouter()
+
+		s.HandleFunc("", withErrorHandler(logger, hdlr.Initiate)).Methods(http.MethodPost)
+		s.HandleFunc("/{uploadId}", withErrorHandler(logger, hdlr.Session)).Methods(http.MethodGet)
+		s.HandleFunc("/{uploadId}", withErrorHandler(logger, hdlr.Abort)).Methods(http.MethodDelete)
+		s.HandleFunc("/{uploadId}/parts/{number}", withErrorHandler(logger, withMaxBodySize(maxPartSize, hdlr.PutPart))).Methods(http.MethodPut)
+		s.HandleFunc("/{uploadId}/complete", withErrorHandler(logger, hdlr.Complete)).Methods(http.MethodPost)
+	})
+	return hdlr
+}
+
+// Initiate starts an upload for the data of the blob with the Content-Type as its BlobType.
+func (uh *UploadHandler) Initiate(rw http.ResponseWriter, req *http.Request) error {
+	blobType := req.Header.Get("Content-Type")
+	if blobType == "" {
+		return badRequestError(errors.New("Content-Type not set"))
+	}
+	session, err := uh.uploads.Initiate(req.Context(), blob.ID(mux.Vars(req)["id"]), blob.BlobType(blobType))
+	if err != nil {
+		return uploadError(err)
+	}
+	return OkJSON(rw, session)
+}
+
+// Session returns the upload and its parts so a client can resume it by uploading the missing parts.
+func (uh *UploadHandler) Session(rw http.ResponseWriter, req *http.Request) error {
+	vars := mux.Vars(req)
+	session, parts, err := uh.uploads.Session(req.Context(), blob.ID(vars["id"]), vars["uploadId"])
+	if err != nil {
+		return uploadError(err)
+	}
+	if parts == nil {
+		parts = []blob.UploadPart{}
+	}
+	return OkJSON(rw, struct {
+		blob.UploadSession
+		Parts []blob.UploadPart `json:"parts"`
+	}{session, parts})
+}
+
+func (uh *UploadHandler) PutPart(rw http.ResponseWriter, req *http.Request) error {
+	vars := mux.Vars(req)
+	number, err := strconv.Atoi(vars["number"])
+	if err != nil {
+		return badRequestError(errors.New("part number should be a number"))
+	}
+	part, err := uh.uploads.PutPart(req.Context(), blob.ID(vars["id"]), vars["uploadId"], number, req.Body)
+	if err != nil {
+		var maxBytesError *http.MaxBytesError
+		if errors.As(err, &maxBytesError) {
+			return readBodyError(err)
+		}
+		return uploadError(err)
+	}
+	return OkJSON(rw, part)
+}
+
+// Complete assembles the upload and creates the blob with it or, if the blob exists, updates its data. The upload
+// is only removed once the command succeeds, so a failed Complete can be retried.
+func (uh *UploadHandler) Complete(rw http.ResponseWriter, req *http.Request) error {
+	vars := mux.Vars(req)
+	id := blob.ID(vars["id"])
+	session, payload, err := uh.uploads.Complete(req.Context(), id, vars["uploadId"], uh.payloads)
+	if err != nil {
+		return uploadError(err)
+	}
+
+	if err := processCommand(uh.aggregateRepo, req, blob.PutFromPayloadCommand(id, session.BlobType, payload), rw); err != nil {
+		return err
+	}
+	// The upload expires if it cannot be removed now.
+	if err := uh.uploads.Remove(req.Context(), id, session.UploadID); err != nil {
+		uh.logger.Info(fmt.Sprintf("cannot remove completed upload %v: %v", session.UploadID, err))
+	}
+	return nil
+}
+
+func (uh *UploadHandler) Abort(rw http.ResponseWriter, req *http.Request) error {
+	vars := mux.Vars(req)
+	if err := uh.uploads.Remove(req.Context(), blob.ID(vars["id"]), vars["uploadId"]); err != nil {
+		return uploadError(err)
+	}
+	rw.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func uploadError(err error) handlerError {
+	if platform.IsMissingAggregate(err) {
+		return notFoundError(err)
+	}
+	if platform.CommandError(err) {
+		return badRequestError(err)
+	}
+	return internalServerError(err)
+}
@@ -1,13 +1,16 @@
 package main
 
 import (
+	"context"
 	_ "expvar"
 	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"sync"
+	"time"
 
 	"github.com/venkssa/eventsourcing/cmd/serverd/handlers"
 	"github.com/venkssa/eventsourcing/internal/blob"
@@ -17,14 +20,97 @@ import (
 	plog "github.com/venkssa/eventsourcing/internal/platform/log"
 )
 
-var eventStoreFilePath = flag.String("eventStoreFilePath", "/tmp/eventstore", "path for event store using file system.")
+var (
+	eventStoreFilePath   = flag.String("eventStoreFilePath", "/tmp/eventstore", "path for event store using file system.")
+	eventStoreType       = flag.String("eventStoreType", "fs", "type of event store: fs for a file per batch of events, segmented for an append-only segmented log.")
+	fsyncPolicy          = flag.String("fsync", "always", "when the fs event store syncs events to disk: always, file or never.")
+	snapshotFilePath     = flag.String("snapshotFilePath", "", "path for snapshots using file system; snapshots are disabled if empty.")
+	snapshotEvery        = flag.Int("snapshotEvery", 100, "number of events after which a new snapshot is taken.")
+	snapshotSize         = flag.Int("snapshotSize", 1<<20, "size in bytes of events after which a new snapshot is taken.")
+	payloadFilePath      = flag.String("payloadFilePath", "", "path for blob data kept apart from events using file system; data is kept in events if empty.")
+	uploadFilePath       = flag.String("uploadFilePath", "", "path for staging uploads in parts using file system; uploads are disabled if empty and need payloadFilePath.")
+	uploadExpiry         = flag.Duration("uploadExpiry", 24*time.Hour, "how long an upload is kept after it last changed before it is removed.")
+	maxBodySize          = flag.Int64("maxBodySize", 32<<20, "size in bytes of the largest request body accepted by the blob routes; 0 for no limit.")
+	maxPartSize          = flag.Int64("maxPartSize", 64<<20, "size in bytes of the largest part of an upload; 0 for no limit.")
+	projectionFilePath   = flag.String("projectionFilePath", "", "path for the state of projections using file system; projections are rebuilt in memory on start if empty.")
+	idempotencyRetention = flag.Duration("idempotencyRetention", blob.DefaultIdempotencyRetention, "how long a command with an Idempotency-Key is not processed again; 0 ignores Idempotency-Key.")
+	segmentSize          = flag.Int64("segmentSize", 64<<20, "size in bytes after which the segmented log event store rolls over to a new segment.")
+)
 
 func main() {
 	flag.Parse()
 	logger := &plog.StdLibLogger{Level: plog.Info, Logger: log.New(os.Stderr, "", log.LstdFlags)}
 
+	store, err := newEventStore()
+	if err != nil {
+		logger.Info(err)
+		os.Exit(1)
+	}
+
+	var repoOpts []blob.Option
+	if *snapshotFilePath != "" {
+		snapshots, err := blob.NewLocalFileSystemSnapshotStore(*snapshotFilePath)
+		if err != nil {
+			logger.Info(err)
+			os.Exit(1)
+		}
+		policy := blob.AnyOf(blob.EveryNEvents(*snapshotEvery), blob.OnSize(blob.DefaultEventRegistry, *snapshotSize))
+		repoOpts = append(repoOpts, blob.WithSnapshots(snapshots, policy))
+	}
+
+	var payloads blob.PayloadStore
+	if *payloadFilePath != "" {
+		payloads, err = blob.NewLocalFileSystemPayloadStore(*payloadFilePath)
+		if err != nil {
+			logger.Info(err)
+			os.Exit(1)
+		}
+		repoOpts = append(repoOpts, blob.WithPayloads(payloads))
+	}
+	repoOpts = append(repoOpts, blob.WithIdempotencyRetention(*idempotencyRetention))
+	repo := blob.NewAggregateRepository(store, repoOpts...)
+
+	indexState, err := newProjectionState("blob-index")
+	if err != nil {
+		logger.Info(err)
+		os.Exit(1)
+	}
+	index := blob.NewBlobIndex(indexState)
+	go runProjector(logger, blob.NewProjector(store, index, indexState, skipFailedEvents(logger)))
+
+	searchState, err := newProjectionState("search")
+	if err != nil {
+		logger.Info(err)
+		os.Exit(1)
+	}
+	search := blob.NewSearchIndex(searchState, payloads)
+	go runProjector(logger, blob.NewProjector(store, search, searchState, skipFailedEvents(logger)))
+
 	hdlrRegs := []handlers.HandlerRegisterer{
-		handlers.NewBlobHandler(logger, blob.NewAggregateRepository(blob.NewLocalFileSystemEventStore(*eventStoreFilePath))),
+		handlers.NewBlobHandler(logger, repo, *maxBodySize),
+		handlers.NewEventsHandler(logger, store),
+		handlers.NewListHandler(logger, index),
+		handlers.NewSearchHandler(logger, search),
+	}
+
+	if *uploadFilePath != "" {
+		if payloads == nil {
+			logger.Info("uploads need payloadFilePath to be set")
+			os.Exit(1)
+		}
+		uploads, err := blob.NewLocalFileSystemUploadStore(*uploadFilePath)
+		if err != nil {
+			logger.Info(err)
+			os.Exit(1)
+		}
+		go func() {
+			for range time.Tick(time.Minute) {
+				if _, err := uploads.Expire(context.Background(), time.Now().Add(-*uploadExpiry)); err != nil {
+					logger.Info(err)
+				}
+			}
+		}()
+		hdlrRegs = append(hdlrRegs, handlers.NewUploadHandler(logger, repo, uploads, payloads, *maxPartSize))
 	}
 
 	muxRouter := mux.NewRouter()
@@ -54,3 +140,38 @@ func main() {
 
 	wg.Wait()
 }
+
+func newEventStore() (blob.EventStore, error) {
+	switch *eventStoreType {
+	case "fs":
+		policy, err := blob.ParseFsyncPolicy(*fsyncPolicy)
+		if err != nil {
+			return nil, err
+		}
+		return blob.NewLocalFileSystemEventStore(*eventStoreFilePath, policy)
+	case "segmented":
+		return blob.NewSegmentedLogEventStore(*eventStoreFilePath, *segmentSize)
+	}
+	return nil, fmt.Errorf("unknown event store type %v", *eventStoreType)
+}
+
+func newProjectionState(name string) (blob.ProjectionState, error) {
+	if *projectionFilePath == "" {
+		return blob.NewInMemoryProjectionState(), nil
+	}
+	return blob.NewLocalFileSystemProjectionState(*projectionFilePath, name)
+}
+
+// runProjector runs the projector until it stops. Commands are still served if it does, with its read model no
+// longer updated.
+func runProjector(logger plog.Logger, projector *blob.Projector) {
+	if err := projector.Run(context.Background()); err != nil {
+		logger.Info(fmt.Sprintf("projection %v stopped: %v", projector.Name(), err))
+	}
+}
+
+func skipFailedEvents(logger plog.Logger) blob.ProjectorOption {
+	return blob.SkipFailedEvents(func(event blob.EventWithMetadata, err error) {
+		logger.Info(fmt.Sprintf("skipped event %d of %v: %v", event.Sequence, event.ID, err))
+	})
+}
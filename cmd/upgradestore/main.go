@@ -0,0 +1,63 @@
+// upgradestore rewrites the events of an event store to the latest schema versions of their event types.
+// Run it while serverd is stopped.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/venkssa/eventsourcing/internal/blob"
+
+	plog "github.com/venkssa/eventsourcing/internal/platform/log"
+)
+
+var (
+	eventStoreFilePath = flag.String("eventStoreFilePath", "/tmp/eventstore", "path for event store using file system.")
+	eventStoreType     = flag.String("eventStoreType", "fs", "type of event store: fs or segmented.")
+	upgradedFilePath   = flag.String("upgradedFilePath", "", "path to write the upgraded segmented log to; required for the segmented event store.")
+	segmentSize        = flag.Int64("segmentSize", 64<<20, "size in bytes after which the segmented log event store rolls over to a new segment.")
+)
+
+func main() {
+	flag.Parse()
+	logger := &plog.StdLibLogger{Level: plog.Info, Logger: log.New(os.Stderr, "", log.LstdFlags)}
+	ctx := context.Background()
+
+	switch *eventStoreType {
+	case "fs":
+		store, err := blob.NewLocalFileSystemEventStore(*eventStoreFilePath, blob.FsyncAlways)
+		if err != nil {
+			logger.Info(err)
+			os.Exit(1)
+		}
+		rewritten, err := store.UpgradeEvents(ctx)
+		if err != nil {
+			logger.Info(err)
+			os.Exit(1)
+		}
+		logger.Info(fmt.Sprintf("rewrote %d batches", rewritten))
+	case "segmented":
+		if *upgradedFilePath == "" {
+			logger.Info("upgradedFilePath is required for the segmented event store")
+			os.Exit(2)
+		}
+		store, err := blob.NewSegmentedLogEventStore(*eventStoreFilePath, *segmentSize)
+		if err != nil {
+			logger.Info(err)
+			os.Exit(1)
+		}
+		defer store.Close()
+		copied, err := store.UpgradeEventsTo(ctx, *upgradedFilePath)
+		if err != nil {
+			logger.Info(err)
+			os.Exit(1)
+		}
+		logger.Info(fmt.Sprintf("copied %d events to %v; replace %v with it before starting serverd", copied, *upgradedFilePath, *eventStoreFilePath))
+	default:
+		logger.Info(fmt.Sprintf("unknown event store type %v", *eventStoreType))
+		os.Exit(2)
+	}
+}
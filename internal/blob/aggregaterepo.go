@@ -1,45 +1,402 @@
 package blob
 
 import (
+	"bytes"
 	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/venkssa/eventsourcing/internal/platform"
 )
 
 type AggregateRepository struct {
-	store EventStore
+	store          EventStore
+	retryPolicy    RetryPolicy
+	snapshots      SnapshotStore
+	snapshotPolicy SnapshotPolicy
+	payloads       PayloadStore
+	// idempotencyRetention is how long after its events are recorded a command with an idempotency key is not
+	// processed again.
+	idempotencyRetention time.Duration
 }
 
-func NewAggregateRepository(store EventStore) AggregateRepository {
-	return AggregateRepository{store}
+// DefaultIdempotencyRetention is how long idempotency keys are honoured unless set with WithIdempotencyRetention.
+const DefaultIdempotencyRetention = 24 * time.Hour
+
+// idempotencyScanBatchSize is how many events are read at a time while looking for an idempotency key.
+const idempotencyScanBatchSize = 100
+
+// idempotencyScanLimit is how many of the latest events of a blob are read while looking for an idempotency key,
+// so a key is not honoured once the blob has had as many later events, even within the retention.
+const idempotencyScanLimit = 1000
+
+// Option configures an AggregateRepository.
+type Option func(*AggregateRepository)
+
+// WithRetryPolicy sets the policy used to retry commands on concurrency conflicts.
+func WithRetryPolicy(retryPolicy RetryPolicy) Option {
+	return func(ar *AggregateRepository) {
+		ar.retryPolicy = retryPolicy
+	}
+}
+
+// WithSnapshots saves snapshots to snapshots as decided by policy and uses them to find aggregates.
+func WithSnapshots(snapshots SnapshotStore, policy SnapshotPolicy) Option {
+	return func(ar *AggregateRepository) {
+		ar.snapshots = snapshots
+		ar.snapshotPolicy = policy
+	}
+}
+
+// WithPayloads keeps the data of new events in payloads so the events only refer to it.
+func WithPayloads(payloads PayloadStore) Option {
+	return func(ar *AggregateRepository) {
+		ar.payloads = payloads
+	}
+}
+
+// WithIdempotencyRetention sets how long idempotency keys are honoured; 0 ignores them.
+func WithIdempotencyRetention(retention time.Duration) Option {
+	return func(ar *AggregateRepository) {
+		ar.idempotencyRetention = retention
+	}
+}
+
+func NewAggregateRepository(store EventStore, opts ...Option) AggregateRepository {
+	ar := AggregateRepository{store: store, retryPolicy: DefaultRetryPolicy, idempotencyRetention: DefaultIdempotencyRetention}
+	for _, opt := range opts {
+		opt(&ar)
+	}
+	return ar
 }
 
 // Find finds an aggregate for the given ID or returns a error if the aggregate cannot be found.
+// With snapshots only the events after the latest snapshot are applied.
 func (ar AggregateRepository) Find(ctx context.Context, id ID) (Blob, error) {
-	events, err := ar.store.Find(ctx, id)
+	blob, _, err := ar.find(ctx, id)
+	return blob, err
+}
+
+// find returns the aggregate and the events applied to it since its latest snapshot.
+func (ar AggregateRepository) find(ctx context.Context, id ID) (Blob, EventWithMetadataSlice, error) {
+	snapshot, err := ar.loadSnapshot(ctx, id)
+	if err != nil {
+		return Blob{}, nil, err
+	}
+
+	snapshot, eventsSinceSnapshot, err := ar.eventsSince(ctx, id, snapshot, math.MaxUint64)
+	if err != nil {
+		return Blob{}, nil, errors.Wrapf(err, "cannot find aggregate for ID %s", id)
+	}
+
+	blob := eventsSinceSnapshot.Apply(snapshot)
+	ar.snapshot(ctx, blob, eventsSinceSnapshot)
+	return blob, eventsSinceSnapshot, nil
+}
+
+// FindAt finds the aggregate as it was once the event with the given sequence was applied.
+// If the aggregate does not have an event with the sequence we return an error with IsMissingAggregate() true.
+func (ar AggregateRepository) FindAt(ctx context.Context, id ID, sequence uint64) (Blob, error) {
+	snapshot, err := ar.loadSnapshot(ctx, id)
 	if err != nil {
-		return Blob{}, errors.Wrapf(err, "cannot find aggregate for ID %s", id)
+		return Blob{}, err
+	}
+	if snapshot.Sequence > sequence {
+		snapshot = Blob{}
+	}
+
+	snapshot, events, err := ar.eventsSince(ctx, id, snapshot, sequence)
+	if err != nil {
+		return Blob{}, errors.Wrapf(err, "cannot find aggregate for ID %s at sequence %d", id, sequence)
+	}
+	blob := events.Apply(snapshot)
+	if sequence == 0 || blob.Sequence != sequence {
+		return Blob{}, missingVersionError(fmt.Errorf("cannot find sequence %d of aggregate for ID %s", sequence, id))
+	}
+	return blob, nil
+}
+
+// FindAsOf finds the aggregate as it was at asOf by applying only the events recorded until then.
+// Events persisted before metadata was recorded do not have a RecordedAt and are always applied.
+// If the aggregate did not exist at asOf we return an error with IsMissingAggregate() true.
+func (ar AggregateRepository) FindAsOf(ctx context.Context, id ID, asOf time.Time) (Blob, error) {
+	snapshot, err := ar.loadSnapshot(ctx, id)
+	if err != nil {
+		return Blob{}, err
+	}
+	if snapshot.UpdatedAt.After(asOf) {
+		snapshot = Blob{}
+	}
+
+	snapshot, events, err := ar.eventsSince(ctx, id, snapshot, math.MaxUint64)
+	if err != nil {
+		return Blob{}, errors.Wrapf(err, "cannot find aggregate for ID %s as of %v", id, asOf)
+	}
+	recorded := 0
+	for recorded < len(events) && !events[recorded].RecordedAt.After(asOf) {
+		recorded++
+	}
+	blob := events[:recorded].Apply(snapshot)
+	if blob.Sequence == 0 {
+		return Blob{}, missingVersionError(fmt.Errorf("cannot find aggregate for ID %s as of %v", id, asOf))
+	}
+	return blob, nil
+}
+
+// eventsSince returns the events of the aggregate after the snapshot up to toSequence. The event the snapshot was
+// taken at is read as well to check that the event store has it. If it does not, the snapshot is ahead of the
+// event store, for example after the event store was restored from a backup, so the snapshot is discarded and
+// all events are returned with an empty snapshot instead.
+func (ar AggregateRepository) eventsSince(ctx context.Context, id ID, snapshot Blob, toSequence uint64) (Blob, EventWithMetadataSlice, error) {
+	if snapshot.Sequence != 0 {
+		events, err := ar.store.FindRange(ctx, id, snapshot.Sequence, toSequence)
+		if err != nil && !platform.IsMissingAggregate(err) {
+			return Blob{}, nil, err
+		}
+		if len(events) != 0 && events[0].Sequence == snapshot.Sequence {
+			return snapshot, events[1:], nil
+		}
+	}
+	events, err := ar.store.FindRange(ctx, id, 1, toSequence)
+	return Blob{}, events, err
+}
+
+func missingVersionError(err error) error {
+	return eventStoreError{isMissingAggregate: true, error: err}
+}
+
+type preconditionFailedError struct {
+	id               ID
+	expectedVersions []uint64
+	expectExisting   bool
+	actualVersion    uint64
+}
+
+func (preconditionFailedError) IsPreconditionFailed() bool {
+	return true
+}
+
+func (p preconditionFailedError) Error() string {
+	if p.expectExisting && p.actualVersion == 0 {
+		return fmt.Sprintf("expected aggregate for ID %s to exist", p.id)
 	}
-	return events.Apply(Blob{}), nil
+	versions := make([]string, len(p.expectedVersions))
+	for i, version := range p.expectedVersions {
+		versions[i] = strconv.FormatUint(version, 10)
+	}
+	return fmt.Sprintf("expected version %s of aggregate for ID %s but found version %d", strings.Join(versions, " or "), p.id, p.actualVersion)
+}
+
+// idempotencyConflictError is returned when an idempotency key is reused with a different command.
+type idempotencyConflictError struct {
+	id       ID
+	key      string
+	sequence uint64
+}
+
+func (idempotencyConflictError) IsIdempotencyConflict() bool {
+	return true
+}
+
+func (i idempotencyConflictError) Error() string {
+	return fmt.Sprintf("idempotency key %q was used at sequence %d of aggregate for ID %s by a different command", i.key, i.sequence, i.id)
+}
+
+// loadSnapshot loads the latest snapshot of the aggregate or an empty Blob if there is none.
+func (ar AggregateRepository) loadSnapshot(ctx context.Context, id ID) (Blob, error) {
+	if ar.snapshots == nil {
+		return Blob{}, nil
+	}
+	snapshot, err := ar.snapshots.Load(ctx, id)
+	if err != nil && !platform.IsMissingAggregate(err) {
+		return Blob{}, errors.Wrapf(err, "cannot load snapshot for ID %s", id)
+	}
+	return snapshot, nil
+}
+
+// snapshot saves a snapshot of blob if the SnapshotPolicy asks for one. A snapshot only speeds up finding
+// the aggregate, so failing to save one is not an error.
+func (ar AggregateRepository) snapshot(ctx context.Context, blob Blob, eventsSinceSnapshot EventWithMetadataSlice) {
+	if ar.snapshots == nil || len(eventsSinceSnapshot) == 0 || !ar.snapshotPolicy.ShouldSnapshot(blob, eventsSinceSnapshot) {
+		return
+	}
+	ar.snapshots.Save(ctx, blob)
 }
 
 // Process applies the command to the aggregate to generate events, persist the newly generated events,
 // apply the new events to the aggrgate and return the updated aggregate or error. error is a CommandError.
+// If another command persisted events for the aggregate after it was read, the command is processed again against
+// the updated aggregate as allowed by the RetryPolicy. Once the retries are exhausted, or ctx does not allow another
+// attempt, the error has IsRetriesExhausted() true. A command with an expected version is not retried once the
+// aggregate has moved past it.
+// If the aggregate has events recorded within the idempotency retention with the idempotency key of the Metadata in
+// ctx, the command is not processed again and the aggregate is returned as it was once those events were applied.
 func (ar AggregateRepository) Process(ctx context.Context, cmd Command) (Blob, error) {
-	blob, err := ar.Find(ctx, cmd.ID)
+	for attempt := 1; ; attempt++ {
+		blob, err := ar.process(ctx, cmd)
+		if err == nil || !platform.IsConcurrencyConflict(err) {
+			return blob, err
+		}
+		if attempt >= ar.retryPolicy.MaxAttempts || !ar.retryPolicy.wait(ctx, attempt) {
+			return Blob{}, retriesExhaustedError{attempts: attempt, lastErr: err}
+		}
+	}
+}
+
+func (ar AggregateRepository) process(ctx context.Context, cmd Command) (Blob, error) {
+	blob, eventsSinceSnapshot, err := ar.find(ctx, cmd.ID)
 	if err != nil && !platform.IsMissingAggregate(err) {
 		return Blob{}, errors.Wrapf(err, "cannot process %v command with %v", cmd.CommandType(), cmd.ID)
 	}
 
+	var fingerprint string
+	if key := MetadataFromContext(ctx).IdempotencyKey; key != "" {
+		if fingerprint, err = cmd.fingerprint(); err != nil {
+			return Blob{}, errors.Wrapf(err, "cannot fingerprint %v command with %v", cmd.CommandType(), cmd.ID)
+		}
+		if ar.idempotencyRetention > 0 {
+			event, found, err := ar.findIdempotencyKey(ctx, blob, key)
+			if err != nil {
+				return Blob{}, errors.Wrapf(err, "cannot check idempotency key of %v command with %v", cmd.CommandType(), cmd.ID)
+			}
+			// Events recorded before fingerprints were recorded cannot be told apart.
+			if found && event.IdempotencyFingerprint != "" && event.IdempotencyFingerprint != fingerprint {
+				return Blob{}, idempotencyConflictError{id: cmd.ID, key: key, sequence: event.Sequence}
+			}
+			if found {
+				return ar.FindAt(ctx, cmd.ID, event.Sequence)
+			}
+		}
+	}
+
+	if !cmd.expects(blob.Sequence) {
+		return Blob{}, preconditionFailedError{
+			id:               cmd.ID,
+			expectedVersions: cmd.expectedVersions,
+			expectExisting:   cmd.expectExisting,
+			actualVersion:    blob.Sequence,
+		}
+	}
+
+	if cmd.resolve != nil {
+		resolved, err := cmd.resolve(ctx, ar, blob)
+		if err != nil {
+			return Blob{}, errors.Wrapf(err, "cannot resolve %v command with %v", cmd.CommandType(), cmd.ID)
+		}
+		cmd = resolved
+	}
 	newEvents, err := cmd.GenerateEvents(blob)
 	if err != nil {
 		return Blob{}, errors.Wrapf(err, "cannot generate events for %v command with %v", cmd.CommandType(), cmd.ID)
 	}
 
-	if err := ar.store.Persist(ctx, cmd.ID, newEvents); err != nil {
+	newEvents, err = ar.externalize(ctx, newEvents)
+	if err != nil {
+		return Blob{}, errors.Wrapf(err, "cannot store payload for %v command with %v", cmd.CommandType(), cmd.ID)
+	}
+
+	newEvents, err = stamp(ctx, newEvents)
+	if err != nil {
+		return Blob{}, errors.Wrapf(err, "cannot record metadata for %v command with %v", cmd.CommandType(), cmd.ID)
+	}
+	for i := range newEvents {
+		newEvents[i].IdempotencyFingerprint = fingerprint
+	}
+
+	if err := ar.store.Persist(ctx, cmd.ID, blob.Sequence, newEvents); err != nil {
 		return Blob{}, errors.Wrapf(err, "failed to persist new events for %v command with %v", cmd.CommandType(), cmd.ID)
 	}
 
-	return newEvents.Apply(blob), nil
+	updatedBlob := newEvents.Apply(blob)
+	eventsSinceSnapshot = append(append(EventWithMetadataSlice{}, eventsSinceSnapshot...), newEvents...)
+	ar.snapshot(ctx, updatedBlob, eventsSinceSnapshot)
+	return updatedBlob, nil
+}
+
+// findIdempotencyKey returns the latest event of the blob with the idempotency key and whether there is one.
+// Only the last idempotencyScanLimit events recorded within the idempotency retention are read, starting with the
+// latest.
+func (ar AggregateRepository) findIdempotencyKey(ctx context.Context, blob Blob, key string) (EventWithMetadata, bool, error) {
+	recordedAfter := time.Now().Add(-ar.idempotencyRetention)
+	last := uint64(1)
+	if blob.Sequence > idempotencyScanLimit {
+		last = blob.Sequence - idempotencyScanLimit + 1
+	}
+	for to := blob.Sequence; to >= last && to > 0; {
+		from := last
+		if to-last >= idempotencyScanBatchSize {
+			from = to - idempotencyScanBatchSize + 1
+		}
+		events, err := ar.store.FindRange(ctx, blob.ID, from, to)
+		if err != nil {
+			return EventWithMetadata{}, false, err
+		}
+		for i := len(events) - 1; i >= 0; i-- {
+			if events[i].RecordedAt.Before(recordedAfter) {
+				return EventWithMetadata{}, false, nil
+			}
+			if events[i].IdempotencyKey == key {
+				return events[i], true, nil
+			}
+		}
+		to = from - 1
+	}
+	return EventWithMetadata{}, false, nil
+}
+
+// externalize moves the data of events into the PayloadStore, if there is one, and refers to it instead.
+func (ar AggregateRepository) externalize(ctx context.Context, events EventWithMetadataSlice) (EventWithMetadataSlice, error) {
+	if ar.payloads == nil {
+		return events, nil
+	}
+	externalized := make(EventWithMetadataSlice, len(events))
+	for i, event := range events {
+		switch e := event.Event.(type) {
+		case CreatedEvent:
+			if len(e.Data) != 0 {
+				ref, err := ar.payloads.Put(ctx, bytes.NewReader(e.Data))
+				if err != nil {
+					return nil, err
+				}
+				event.Event = CreatedEvent{BlobType: e.BlobType, Payload: &ref}
+			}
+		case DataUpdatedEvent:
+			if len(e.Data) != 0 {
+				ref, err := ar.payloads.Put(ctx, bytes.NewReader(e.Data))
+				if err != nil {
+					return nil, err
+				}
+				event.Event = DataUpdatedEvent{Payload: &ref}
+			}
+		}
+		externalized[i] = event
+	}
+	return externalized, nil
+}
+
+// OpenData opens the data of the blob, whether it is held by the blob or kept in the PayloadStore.
+func (ar AggregateRepository) OpenData(ctx context.Context, blob Blob) (io.ReadSeekCloser, error) {
+	if blob.Payload == nil {
+		return bytesPayload{bytes.NewReader(blob.Data)}, nil
+	}
+	if ar.payloads == nil {
+		return nil, fmt.Errorf("cannot open payload %v of blob %v without a payload store", blob.Payload.Digest, blob.ID)
+	}
+	return ar.payloads.Open(ctx, *blob.Payload)
+}
+
+// ReadData reads all of the data of the blob.
+func (ar AggregateRepository) ReadData(ctx context.Context, blob Blob) ([]byte, error) {
+	data, err := ar.OpenData(ctx, blob)
+	if err != nil {
+		return nil, err
+	}
+	defer data.Close()
+	return ioutil.ReadAll(data)
 }
@@ -2,8 +2,14 @@ package blob
 
 import (
 	"context"
+	"io/ioutil"
+	"os"
 	"reflect"
+	"strconv"
 	"testing"
+	"time"
+
+	"github.com/venkssa/eventsourcing/internal/platform"
 )
 
 func TestNewCreateCommand(t *testing.T) {
@@ -26,3 +32,320 @@ func TestNewCreateCommand(t *testing.T) {
 
 	t.Logf("%T", blob)
 }
+
+// racingEventStore persists an event from a competing writer before each of the first races Persist calls.
+type racingEventStore struct {
+	EventStore
+	races int
+}
+
+func (r *racingEventStore) Persist(ctx context.Context, id ID, expectedVersion uint64, events EventWithMetadataSlice) error {
+	if r.races > 0 {
+		r.races--
+		if err := r.EventStore.Persist(ctx, id, expectedVersion, wrap(id, expectedVersion+1, TagsAddedEvent{"racer": "1"})); err != nil {
+			return err
+		}
+	}
+	return r.EventStore.Persist(ctx, id, expectedVersion, events)
+}
+
+func TestProcessRetriesOnConcurrencyConflict(t *testing.T) {
+	store := &racingEventStore{EventStore: NewInMemoryEventStore()}
+	repo := NewAggregateRepository(store, WithRetryPolicy(RetryPolicy{MaxAttempts: 3}))
+	ctx := context.Background()
+
+	if _, err := repo.Process(ctx, CreateCommand("1", "application/text", []byte("hello"))); err != nil {
+		t.Fatal(err)
+	}
+
+	store.races = 2
+	blob, err := repo.Process(ctx, UpdateTagsCommand("1", Tags{"mine": "2"}, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedTags := Tags{"racer": "1", "mine": "2"}
+	if blob.Sequence != 4 || !reflect.DeepEqual(blob.Tags, expectedTags) {
+		t.Fatalf("Expected tags %v at sequence 4 but was %v at sequence %v", expectedTags, blob.Tags, blob.Sequence)
+	}
+
+	store.races = 3
+	_, err = repo.Process(ctx, UpdateTagsCommand("1", Tags{"mine": "3"}, nil))
+	if !platform.IsRetriesExhausted(err) {
+		t.Fatalf("Expected retries to be exhausted but got '%v'", err)
+	}
+}
+
+func TestProcessRecordsMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := NewLocalFileSystemEventStore(dir, FsyncNever)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := NewAggregateRepository(store)
+	ctx := WithMetadata(context.Background(), Metadata{
+		CorrelationID: "request-1",
+		Actor:         "alice",
+		Headers:       map[string]string{"reason": "test"},
+	})
+
+	if _, err := repo.Process(ctx, CreateCommand("1", "application/text", []byte("hello"))); err != nil {
+		t.Fatal(err)
+	}
+	blob, err := repo.Process(ctx, UpdateTagsCommand("1", Tags{"a": "b"}, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := store.Find(context.Background(), "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, event := range events {
+		md := event.Metadata
+		if md.EventID == "" || md.RecordedAt.IsZero() || md.CorrelationID != "request-1" || md.Actor != "alice" ||
+			md.Headers["reason"] != "test" {
+			t.Fatalf("Expected metadata from the context but got %#v", md)
+		}
+	}
+	if events[0].EventID == events[1].EventID {
+		t.Fatalf("Expected unique event IDs but got %v twice", events[0].EventID)
+	}
+
+	foundBlob, err := repo.Find(context.Background(), "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(blob, foundBlob) {
+		t.Fatalf("Expected %#v but was %#v", blob, foundBlob)
+	}
+	if blob.CreatedAt != events[0].RecordedAt || blob.UpdatedAt != events[1].RecordedAt || blob.UpdatedBy != "alice" {
+		t.Fatalf("Expected blob timestamps from the events but was %#v", blob)
+	}
+}
+
+func TestFindAtAndAsOf(t *testing.T) {
+	store := NewInMemoryEventStore()
+	repo := NewAggregateRepository(store, WithSnapshots(NewInMemorySnapshotStore(), EveryNEvents(2)))
+	ctx := context.Background()
+
+	var versions []Blob
+	for _, cmd := range []Command{
+		CreateCommand("1", "text/plain", []byte("one")),
+		UpdateCommand("1", []byte("two"), false),
+		UpdateTagsCommand("1", Tags{"a": "b"}, nil),
+		DeleteCommand("1"),
+	} {
+		blob, err := repo.Process(ctx, cmd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		versions = append(versions, blob)
+	}
+	events, err := store.Find(ctx, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, expected := range versions {
+		blob, err := repo.FindAt(ctx, "1", uint64(i+1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(blob, expected) {
+			t.Fatalf("Expected %#v at sequence %d but was %#v", expected, i+1, blob)
+		}
+		blob, err = repo.FindAsOf(ctx, "1", events[i].RecordedAt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if blob.Sequence < expected.Sequence {
+			t.Fatalf("Expected at least sequence %d as of %v but was %d", expected.Sequence, events[i].RecordedAt, blob.Sequence)
+		}
+	}
+
+	if _, err := repo.FindAt(ctx, "1", 5); !platform.IsMissingAggregate(err) {
+		t.Fatalf("Expected a missing sequence to be a missing aggregate but got '%v'", err)
+	}
+	if _, err := repo.FindAsOf(ctx, "1", events[0].RecordedAt.Add(-time.Second)); !platform.IsMissingAggregate(err) {
+		t.Fatalf("Expected a blob before its creation to be a missing aggregate but got '%v'", err)
+	}
+}
+
+func TestProcessRevertCommand(t *testing.T) {
+	repo := NewAggregateRepository(NewInMemoryEventStore())
+	ctx := context.Background()
+
+	for _, cmd := range []Command{
+		CreateCommand("1", "text/plain", []byte("one")),
+		UpdateTagsCommand("1", Tags{"a": "b"}, nil),
+		UpdateCommand("1", []byte("two"), false),
+		UpdateTagsCommand("1", Tags{"c": "d"}, []string{"a"}),
+		DeleteCommand("1"),
+	} {
+		if _, err := repo.Process(ctx, cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	blob, err := repo.Process(ctx, RevertCommand("1", 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blob.Deleted || string(blob.Data) != "one" || !reflect.DeepEqual(blob.Tags, Tags{"a": "b"}) {
+		t.Fatalf("Expected the blob to be reverted to sequence 2 but was %#v", blob)
+	}
+
+	for _, targetSequence := range []uint64{0, blob.Sequence, blob.Sequence + 1} {
+		if _, err := repo.Process(ctx, RevertCommand("1", targetSequence)); !platform.CommandError(err) {
+			t.Fatalf("Expected reverting to sequence %d to be a command error but got '%v'", targetSequence, err)
+		}
+	}
+	if _, err := repo.Process(ctx, RevertCommand("2", 1)); !platform.CommandError(err) {
+		t.Fatalf("Expected reverting a missing blob to be a command error but got '%v'", err)
+	}
+	if _, err := RevertCommand("1", 2).GenerateEvents(blob); !platform.CommandError(err) {
+		t.Fatalf("Expected a revert outside of Process to be a command error but got '%v'", err)
+	}
+}
+
+func TestProcessRevertCommandRetriesWithTheUpdatedBlob(t *testing.T) {
+	ctx := context.Background()
+	store := &racingEventStore{EventStore: NewInMemoryEventStore()}
+	repo := NewAggregateRepository(store)
+	for _, cmd := range []Command{
+		CreateCommand("1", "text/plain", []byte("one")),
+		UpdateCommand("1", []byte("two"), false),
+	} {
+		if _, err := repo.Process(ctx, cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	store.races = 1
+	blob, err := repo.Process(ctx, RevertCommand("1", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blob.Sequence != 5 || string(blob.Data) != "one" || len(blob.Tags) != 0 {
+		t.Fatalf("Expected the retried revert to undo the competing change but was %#v", blob)
+	}
+}
+
+func TestProcessWithExpectedVersion(t *testing.T) {
+	repo := NewAggregateRepository(NewInMemoryEventStore())
+	ctx := context.Background()
+
+	if _, err := repo.Process(ctx, CreateCommand("1", "text/plain", []byte("one")).WithExpectedVersion(0)); err != nil {
+		t.Fatal(err)
+	}
+	blob, err := repo.Process(ctx, UpdateCommand("1", []byte("two"), false).WithExpectedVersion(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blob.Sequence != 2 {
+		t.Fatalf("Expected sequence 2 but was %d", blob.Sequence)
+	}
+
+	_, err = repo.Process(ctx, UpdateCommand("1", []byte("three"), false).WithExpectedVersion(1))
+	if !platform.IsPreconditionFailed(err) {
+		t.Fatalf("Expected a stale expected version to fail the precondition but got '%v'", err)
+	}
+	if _, err := repo.Process(ctx, UpdateCommand("1", []byte("three"), false).WithExpectedVersion(1, 2)); err != nil {
+		t.Fatalf("Expected any of the expected versions to match but got '%v'", err)
+	}
+
+	if _, err := repo.Process(ctx, DeleteCommand("1").WithExistingAggregate()); err != nil {
+		t.Fatal(err)
+	}
+	_, err = repo.Process(ctx, CreateCommand("2", "text/plain", []byte("one")).WithExistingAggregate())
+	if !platform.IsPreconditionFailed(err) {
+		t.Fatalf("Expected a missing aggregate to fail the precondition but got '%v'", err)
+	}
+}
+
+func TestProcessWithIdempotencyKey(t *testing.T) {
+	store := NewInMemoryEventStore()
+	repo := NewAggregateRepository(store)
+	create := WithMetadata(context.Background(), Metadata{IdempotencyKey: "create"})
+	update := WithMetadata(context.Background(), Metadata{IdempotencyKey: "update"})
+
+	for i := 0; i < 2; i++ {
+		blob, err := repo.Process(create, CreateCommand("1", "text/plain", []byte("one")))
+		if err != nil {
+			t.Fatalf("Expected a repeated create to return the created blob but got '%v'", err)
+		}
+		if blob.Sequence != 1 || string(blob.Data) != "one" {
+			t.Fatalf("Expected the created blob but got %+v", blob)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		blob, err := repo.Process(update, UpdateCommand("1", []byte("two"), false).WithExpectedVersion(1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if blob.Sequence != 2 {
+			t.Fatalf("Expected a repeated update to return sequence 2 but got %d", blob.Sequence)
+		}
+	}
+	if _, err := repo.Process(context.Background(), UpdateCommand("1", []byte("three"), false)); err != nil {
+		t.Fatal(err)
+	}
+	blob, err := repo.Process(create, CreateCommand("1", "text/plain", []byte("one")))
+	if err != nil || blob.Sequence != 1 {
+		t.Fatalf("Expected the blob as it was created but got %+v, '%v'", blob, err)
+	}
+
+	for name, cmd := range map[string]Command{
+		"different arguments": CreateCommand("1", "text/plain", []byte("other")),
+		"different command":   UpdateCommand("1", []byte("one"), false),
+	} {
+		if _, err := repo.Process(create, cmd); !platform.IsIdempotencyConflict(err) {
+			t.Fatalf("Expected reusing the idempotency key with %s to be a conflict but got '%v'", name, err)
+		}
+	}
+
+	events, err := store.Find(context.Background(), "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 3 || events[0].IdempotencyKey != "create" || events[1].IdempotencyKey != "update" {
+		t.Fatalf("Expected the idempotency keys to be recorded once but got %+v", events)
+	}
+
+	expired := NewAggregateRepository(store, WithIdempotencyRetention(time.Nanosecond))
+	blob, err = expired.Process(update, UpdateCommand("1", []byte("two"), false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blob.Sequence != 4 {
+		t.Fatalf("Expected an expired idempotency key to be processed again but got sequence %d", blob.Sequence)
+	}
+}
+
+func TestFindIdempotencyKeyReadsLatestEventsOnly(t *testing.T) {
+	store := NewInMemoryEventStore()
+	repo := NewAggregateRepository(store)
+	ctx := context.Background()
+
+	keyed := WithMetadata(ctx, Metadata{IdempotencyKey: "create"})
+	if _, err := repo.Process(keyed, CreateCommand("1", "text/plain", []byte("one"))); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < idempotencyScanLimit; i++ {
+		if _, err := repo.Process(ctx, UpdateTagsCommand("1", Tags{"i": strconv.Itoa(i)}, nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	blob, err := repo.Find(ctx, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, found, err := repo.findIdempotencyKey(ctx, blob, "create"); err != nil || found {
+		t.Fatalf("Expected a key older than the scan limit not to be found but got %v, '%v'", found, err)
+	}
+}
@@ -1,5 +1,7 @@
 package blob
 
+import "time"
+
 type ID string
 
 func (id ID) String() string {
@@ -22,8 +24,15 @@ func (bt BlobType) String() string {
 type Blob struct {
 	ID
 	BlobType
-	Data     []byte
+	Data []byte
+	// Payload refers to the data in a PayloadStore when it is not kept in Data.
+	Payload  *PayloadRef
 	Deleted  bool
 	Sequence uint64
 	Tags
+	// CreatedAt and UpdatedAt are when the first and the last event of the blob were recorded.
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	// UpdatedBy is the actor of the last event.
+	UpdatedBy string
 }
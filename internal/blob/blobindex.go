@@ -0,0 +1,296 @@
+package blob
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/venkssa/eventsourcing/internal/tagquery"
+)
+
+const (
+	defaultBlobQueryLimit = 100
+	maxBlobQueryLimit     = 1000
+
+	blobIndexBlobKeyPrefix = "blob/"
+	blobIndexTagKeyPrefix  = "tag/"
+)
+
+// BlobSummary is a blob without its data as kept by the BlobIndex.
+type BlobSummary struct {
+	ID        `json:"id"`
+	BlobType  `json:"blobType"`
+	Tags      `json:"tags"`
+	Deleted   bool      `json:"deleted"`
+	Sequence  uint64    `json:"sequence"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// TagFilter matches blobs with the tag Key and, if HasValue, with the tag Value. If Prefix, Value is a prefix of the
+// tag value instead.
+type TagFilter struct {
+	Key      string
+	Value    string
+	HasValue bool
+	Prefix   bool
+}
+
+// TagMatcher matches the tags of a blob, such as a tagquery.Expr.
+type TagMatcher interface {
+	Match(tags map[string]string) bool
+}
+
+// BlobQuery finds the blobs that match all of its filters. A zero BlobType or nil Deleted or TagQuery match any
+// blob. Cursor is the NextCursor of the previous page.
+type BlobQuery struct {
+	Tags     []TagFilter
+	TagQuery TagMatcher
+	BlobType BlobType
+	Deleted  *bool
+	Cursor   string
+	Limit    int
+}
+
+// BlobPage is a page of blobs ordered by ID. NextCursor is empty on the last page.
+type BlobPage struct {
+	Blobs      []BlobSummary `json:"blobs"`
+	NextCursor string        `json:"nextCursor,omitempty"`
+}
+
+// BlobIndex is a Projection of all blobs indexed by tag. It is kept up to date by a Projector from the events in an
+// EventStore, so it lags slightly behind commands.
+//
+// The summary of each blob is kept under blob/<id> and each tag of a blob under tag/<key>/<value>/<id>, with the
+// key and value escaped so the IDs of the blobs with a tag are found by their key prefix in ascending order.
+type BlobIndex struct {
+	mux   *sync.RWMutex
+	state ProjectionState
+}
+
+// NewBlobIndex returns a BlobIndex kept in state, which has to be the state its Projector keeps it in.
+func NewBlobIndex(state ProjectionState) *BlobIndex {
+	return &BlobIndex{mux: new(sync.RWMutex), state: state}
+}
+
+func (bi *BlobIndex) Name() string {
+	return "blob-index"
+}
+
+// Handles returns no prototypes as every event changes the summary of its blob.
+func (bi *BlobIndex) Handles() []Event {
+	return nil
+}
+
+// Project applies the event to the summary of its blob and updates the keys of the tags that changed.
+func (bi *BlobIndex) Project(ctx context.Context, state ProjectionState, event EventWithMetadata) error {
+	bi.mux.Lock()
+	defer bi.mux.Unlock()
+
+	var existing BlobSummary
+	if _, err := state.Get(ctx, blobIndexBlobKey(event.ID), &existing); err != nil {
+		return err
+	}
+	applied := event.Apply(Blob{
+		ID:        existing.ID,
+		BlobType:  existing.BlobType,
+		Tags:      existing.Tags,
+		Deleted:   existing.Deleted,
+		Sequence:  existing.Sequence,
+		UpdatedAt: existing.UpdatedAt,
+	})
+
+	for key, value := range existing.Tags {
+		if newValue, ok := applied.Tags[key]; !ok || newValue != value {
+			if err := state.Delete(ctx, blobIndexTagKey(key, value, event.ID)); err != nil {
+				return err
+			}
+		}
+	}
+	for key, value := range applied.Tags {
+		if oldValue, ok := existing.Tags[key]; !ok || oldValue != value {
+			if err := state.Put(ctx, blobIndexTagKey(key, value, event.ID), true); err != nil {
+				return err
+			}
+		}
+	}
+	return state.Put(ctx, blobIndexBlobKey(event.ID), BlobSummary{
+		ID:        applied.ID,
+		BlobType:  applied.BlobType,
+		Tags:      applied.Tags,
+		Deleted:   applied.Deleted,
+		Sequence:  applied.Sequence,
+		UpdatedAt: applied.UpdatedAt,
+	})
+}
+
+// Query returns the page of blobs matching the query that follows the Cursor.
+func (bi *BlobIndex) Query(ctx context.Context, query BlobQuery) (BlobPage, error) {
+	after, err := decodeCursor(query.Cursor)
+	if err != nil {
+		return BlobPage{}, err
+	}
+	limit := query.Limit
+	if limit == 0 {
+		limit = defaultBlobQueryLimit
+	}
+	if limit < 0 || limit > maxBlobQueryLimit {
+		return BlobPage{}, commandError(fmt.Sprintf("limit should be between 1 and %d", maxBlobQueryLimit))
+	}
+
+	bi.mux.RLock()
+	defer bi.mux.RUnlock()
+
+	candidates, err := bi.candidates(ctx, query)
+	if err != nil {
+		return BlobPage{}, err
+	}
+	start := sort.Search(len(candidates), func(i int) bool { return candidates[i] > after })
+
+	page := BlobPage{Blobs: []BlobSummary{}}
+	for _, id := range candidates[start:] {
+		var summary BlobSummary
+		found, err := bi.state.Get(ctx, blobIndexBlobKey(id), &summary)
+		if err != nil {
+			return BlobPage{}, err
+		}
+		if !found || !query.matches(summary) {
+			continue
+		}
+		if len(page.Blobs) == limit {
+			page.NextCursor = encodeCursor(page.Blobs[limit-1].ID)
+			break
+		}
+		page.Blobs = append(page.Blobs, summary)
+	}
+	return page, nil
+}
+
+// candidates returns the IDs of the blobs that may match the query in ascending order. These are the blobs with the
+// tags of the tag filter with the fewest blobs, including the filters every match of a tag query has to pass, or
+// all blobs if there are no such filters.
+func (bi *BlobIndex) candidates(ctx context.Context, query BlobQuery) ([]ID, error) {
+	filters := append(append([]TagFilter(nil), query.Tags...), tagQueryFilters(query.TagQuery)...)
+	if len(filters) == 0 {
+		return bi.all(ctx)
+	}
+	var candidates []ID
+	for i, filter := range filters {
+		ids, err := bi.tagged(ctx, filter)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 || len(ids) < len(candidates) {
+			candidates = ids
+		}
+	}
+	return candidates, nil
+}
+
+// tagQueryFilters returns the tag filters that every blob matching a tagquery.Expr passes: the key=value,
+// key^=prefix and has(key) comparisons joined by AND at the top of the query.
+func tagQueryFilters(matcher TagMatcher) []TagFilter {
+	switch expr := matcher.(type) {
+	case tagquery.And:
+		return append(tagQueryFilters(expr.Left), tagQueryFilters(expr.Right)...)
+	case tagquery.Equals:
+		return []TagFilter{{Key: expr.Key, Value: expr.Value, HasValue: true}}
+	case tagquery.Prefix:
+		return []TagFilter{{Key: expr.Key, Value: expr.Prefix, HasValue: true, Prefix: true}}
+	case tagquery.Has:
+		return []TagFilter{{Key: expr.Key}}
+	}
+	return nil
+}
+
+// all returns the IDs of all blobs in ascending order.
+func (bi *BlobIndex) all(ctx context.Context) ([]ID, error) {
+	keys, err := bi.state.Keys(ctx, blobIndexBlobKeyPrefix)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]ID, len(keys))
+	for i, key := range keys {
+		ids[i] = ID(strings.TrimPrefix(key, blobIndexBlobKeyPrefix))
+	}
+	return ids, nil
+}
+
+// tagged returns the IDs of the blobs matching the tag filter in ascending order.
+func (bi *BlobIndex) tagged(ctx context.Context, filter TagFilter) ([]ID, error) {
+	prefix := blobIndexTagKeyPrefix + url.PathEscape(filter.Key) + "/"
+	exact := filter.HasValue && !filter.Prefix
+	if filter.HasValue {
+		// Values are escaped byte by byte, so the escaped prefix of a value is a prefix of the escaped value.
+		prefix += url.PathEscape(filter.Value)
+	}
+	if exact {
+		prefix += "/"
+	}
+	keys, err := bi.state.Keys(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]ID, len(keys))
+	for i, key := range keys {
+		ids[i] = blobIndexTaggedID(key)
+	}
+	if !exact {
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	}
+	return ids, nil
+}
+
+func (q BlobQuery) matches(blob BlobSummary) bool {
+	if q.BlobType != "" && blob.BlobType != q.BlobType {
+		return false
+	}
+	if q.Deleted != nil && blob.Deleted != *q.Deleted {
+		return false
+	}
+	for _, tag := range q.Tags {
+		value, ok := blob.Tags[tag.Key]
+		if !ok {
+			return false
+		}
+		if tag.Prefix && !strings.HasPrefix(value, tag.Value) || tag.HasValue && !tag.Prefix && value != tag.Value {
+			return false
+		}
+	}
+	if q.TagQuery != nil && !q.TagQuery.Match(blob.Tags) {
+		return false
+	}
+	return true
+}
+
+func blobIndexBlobKey(id ID) string {
+	return blobIndexBlobKeyPrefix + id.String()
+}
+
+func blobIndexTagKey(key string, value string, id ID) string {
+	return blobIndexTagKeyPrefix + url.PathEscape(key) + "/" + url.PathEscape(value) + "/" + id.String()
+}
+
+// blobIndexTaggedID returns the ID of a tag key, which follows the escaped tag key and value as these have no
+// slashes.
+func blobIndexTaggedID(key string) ID {
+	rest := strings.TrimPrefix(key, blobIndexTagKeyPrefix)
+	rest = rest[strings.IndexByte(rest, '/')+1:]
+	return ID(rest[strings.IndexByte(rest, '/')+1:])
+}
+
+func encodeCursor(id ID) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(id))
+}
+
+func decodeCursor(cursor string) (ID, error) {
+	id, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", commandError(fmt.Sprintf("invalid cursor %q", cursor))
+	}
+	return ID(id), nil
+}
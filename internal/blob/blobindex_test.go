@@ -0,0 +1,125 @@
+package blob
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/venkssa/eventsourcing/internal/tagquery"
+)
+
+func TestBlobIndexQuery(t *testing.T) {
+	store := NewInMemoryEventStore()
+	repo := NewAggregateRepository(store)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	state := NewInMemoryProjectionState()
+	index := NewBlobIndex(state)
+	projector := NewProjector(store, index, state)
+	done := make(chan error)
+	go func() { done <- projector.Run(ctx) }()
+
+	for _, cmd := range []Command{
+		CreateCommand("c", "application/json", []byte("{}")),
+		CreateCommand("a", "text/plain", []byte("a")),
+		CreateCommand("b", "text/plain", []byte("b")),
+		UpdateTagsCommand("a", Tags{"env": "prod", "team": "x"}, nil),
+		UpdateTagsCommand("b", Tags{"env": "dev"}, nil),
+		UpdateTagsCommand("c", Tags{"env": "prod"}, nil),
+		UpdateTagsCommand("a", Tags{"env": "dev"}, []string{"team"}),
+		DeleteCommand("c"),
+	} {
+		if _, err := repo.Process(ctx, cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status, err := projector.Status(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.Lag == 0 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	notDeleted := false
+	tests := map[string]struct {
+		Query       BlobQuery
+		ExpectedIDs []ID
+	}{
+		"all blobs are ordered by ID": {BlobQuery{}, []ID{"a", "b", "c"}},
+		"tag key and value":           {BlobQuery{Tags: []TagFilter{{Key: "env", Value: "dev", HasValue: true}}}, []ID{"a", "b"}},
+		"tag key":                     {BlobQuery{Tags: []TagFilter{{Key: "env"}}}, []ID{"a", "b", "c"}},
+		"removed tag":                 {BlobQuery{Tags: []TagFilter{{Key: "team"}}}, nil},
+		"no blobs of a type that are not deleted":          {BlobQuery{BlobType: "application/json", Deleted: &notDeleted}, nil},
+		"deleted blobs without a deleted filter":           {BlobQuery{Tags: []TagFilter{{Key: "env", Value: "prod", HasValue: true}}}, []ID{"c"}},
+		"not deleted with the tag value of a deleted blob": {BlobQuery{Tags: []TagFilter{{Key: "env", Value: "prod", HasValue: true}}, Deleted: &notDeleted}, nil},
+		"blobs that are not deleted":                       {BlobQuery{Deleted: &notDeleted}, []ID{"a", "b"}},
+		"tag query":                                        {BlobQuery{TagQuery: tagquery.Or{Left: tagquery.Equals{Key: "env", Value: "prod"}, Right: tagquery.Prefix{Key: "env", Prefix: "de"}}}, []ID{"a", "b", "c"}},
+		"tag query and tag filter":                         {BlobQuery{Tags: []TagFilter{{Key: "env"}}, TagQuery: tagquery.Not{Expr: tagquery.Equals{Key: "env", Value: "dev"}}}, []ID{"c"}},
+		"tag value prefix":                                 {BlobQuery{Tags: []TagFilter{{Key: "env", Value: "pr", HasValue: true, Prefix: true}}}, []ID{"c"}},
+		"tag query of AND comparisons":                     {BlobQuery{TagQuery: tagquery.And{Left: tagquery.Has{Key: "env"}, Right: tagquery.Prefix{Key: "env", Prefix: "d"}}}, []ID{"a", "b"}},
+		"tag query of AND with NOT":                        {BlobQuery{TagQuery: tagquery.And{Left: tagquery.Not{Expr: tagquery.Has{Key: "team"}}, Right: tagquery.Equals{Key: "env", Value: "prod"}}}, []ID{"c"}},
+	}
+	for testName, data := range tests {
+		t.Run(testName, func(t *testing.T) {
+			page, err := index.Query(ctx, data.Query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ids []ID
+			for _, blob := range page.Blobs {
+				ids = append(ids, blob.ID)
+			}
+			if !reflect.DeepEqual(ids, data.ExpectedIDs) {
+				t.Fatalf("Expected %v but got %v", data.ExpectedIDs, ids)
+			}
+		})
+	}
+
+	var ids []ID
+	for query := (BlobQuery{Limit: 2}); ; {
+		page, err := index.Query(ctx, query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, blob := range page.Blobs {
+			ids = append(ids, blob.ID)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		query.Cursor = page.NextCursor
+	}
+	if !reflect.DeepEqual(ids, []ID{"a", "b", "c"}) {
+		t.Fatalf("Expected pages of all blobs but got %v", ids)
+	}
+
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("Expected the index to stop with the context but got '%v'", err)
+	}
+}
+
+func TestTagQueryFilters(t *testing.T) {
+	expr, err := tagquery.Parse(`env=prod AND (team=a OR team=b) AND NOT has(archived) AND region^=eu AND has(owner)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []TagFilter{
+		{Key: "env", Value: "prod", HasValue: true},
+		{Key: "region", Value: "eu", HasValue: true, Prefix: true},
+		{Key: "owner"},
+	}
+	if filters := tagQueryFilters(expr); !reflect.DeepEqual(filters, expected) {
+		t.Fatalf("Expected %v but got %v", expected, filters)
+	}
+	if filters := tagQueryFilters(tagquery.Or{Left: tagquery.Has{Key: "a"}, Right: tagquery.Has{Key: "b"}}); filters != nil {
+		t.Fatalf("Expected no filters for OR but got %v", filters)
+	}
+}
@@ -1,7 +1,12 @@
 package blob
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"sort"
 )
 
 type Command struct {
@@ -9,9 +14,58 @@ type Command struct {
 	commandType    string
 	eventGenerator func(Blob) EventWithMetadataSlice
 	validator      func(Blob) error
+	// args are the arguments of the command, so a retry with an idempotency key can be told apart from a
+	// different command reusing the key.
+	args []interface{}
+	// resolve, if set, returns the command to validate and generate events with for the aggregate, after reading
+	// what else it needs from the repository. It is called by AggregateRepository.Process on every attempt, so it
+	// reads the same events as the aggregate.
+	resolve func(ctx context.Context, ar AggregateRepository, b Blob) (Command, error)
+
+	expectVersion    bool
+	expectedVersions []uint64
+	expectExisting   bool
+}
+
+// WithExpectedVersion returns a copy of the command that is only processed while the sequence of the aggregate
+// is one of expectedVersions. Otherwise AggregateRepository.Process returns an error with IsPreconditionFailed()
+// true.
+func (c Command) WithExpectedVersion(expectedVersions ...uint64) Command {
+	c.expectVersion = true
+	c.expectedVersions = expectedVersions
+	return c
+}
+
+// WithExistingAggregate returns a copy of the command that is only processed if the aggregate exists, whatever
+// its version. Otherwise AggregateRepository.Process returns an error with IsPreconditionFailed() true.
+func (c Command) WithExistingAggregate() Command {
+	c.expectExisting = true
+	return c
+}
+
+// expects reports whether the command can be processed with the aggregate at version.
+func (c Command) expects(version uint64) bool {
+	if c.expectExisting && version == 0 {
+		return false
+	}
+	if !c.expectVersion {
+		return true
+	}
+	for _, expectedVersion := range c.expectedVersions {
+		if version == expectedVersion {
+			return true
+		}
+	}
+	return false
 }
 
+// GenerateEvents validates the command against the aggregate and returns the events it generates. A command that
+// reads more than the aggregate, such as RevertCommand, can only be processed by AggregateRepository.Process and
+// returns a CommandError.
 func (c Command) GenerateEvents(b Blob) (EventWithMetadataSlice, error) {
+	if c.resolve != nil {
+		return nil, commandError(fmt.Sprintf("%v command with %v has to be processed by an AggregateRepository", c.commandType, c.ID))
+	}
 	if err := c.validator(b); err != nil {
 		return nil, err
 	}
@@ -22,6 +76,15 @@ func (c Command) CommandType() string {
 	return c.commandType
 }
 
+// fingerprint identifies what the command does by its type and a digest of the JSON encoding of its arguments.
+func (c Command) fingerprint() (string, error) {
+	hash := sha256.New()
+	if err := json.NewEncoder(hash).Encode(c.args); err != nil {
+		return "", err
+	}
+	return c.commandType + ":" + hex.EncodeToString(hash.Sum(nil)), nil
+}
+
 var (
 	errEmptyID = commandError("ID should not be empty")
 )
@@ -40,6 +103,7 @@ func CreateCommand(aggregateID ID, blobType BlobType, data []byte) Command {
 	return Command{
 		ID:          aggregateID,
 		commandType: "CREATE",
+		args:        []interface{}{aggregateID, blobType, data},
 		validator: func(b Blob) error {
 			if b.Deleted {
 				return commandError("cannot create a deleted blob")
@@ -65,6 +129,7 @@ func UpdateCommand(aggregateID ID, updatedData []byte, clearData bool) Command {
 	return Command{
 		ID:          aggregateID,
 		commandType: "UPDATE",
+		args:        []interface{}{aggregateID, updatedData, clearData},
 		validator: func(b Blob) error {
 			if err := validateID(b.ID, aggregateID); err != nil {
 				return err
@@ -89,10 +154,46 @@ func UpdateCommand(aggregateID ID, updatedData []byte, clearData bool) Command {
 	}
 }
 
+// PutFromPayloadCommand creates a blob with data already kept in a PayloadStore or, if the blob exists, updates
+// its data to the payload. Whether the blob exists is decided against the aggregate the command is processed with,
+// so a concurrent create turns the command into an update. The BlobType has to match that of an existing blob.
+func PutFromPayloadCommand(aggregateID ID, blobType BlobType, payload PayloadRef) Command {
+	return Command{
+		ID:          aggregateID,
+		commandType: "PUT_PAYLOAD",
+		args:        []interface{}{aggregateID, blobType, payload},
+		validator: func(b Blob) error {
+			if aggregateID == "" {
+				return errEmptyID
+			}
+			if blobType == "" {
+				return commandError("BlobType should not be empty")
+			}
+			if b.Deleted {
+				return commandError("cannot update a deleted blob")
+			}
+			if b.Sequence != 0 && b.BlobType != blobType {
+				return commandError(fmt.Sprintf("cannot update a blob of type %v with data of type %v", b.BlobType, blobType))
+			}
+			return nil
+		},
+		eventGenerator: func(b Blob) EventWithMetadataSlice {
+			if b.Sequence == 0 {
+				return wrap(aggregateID, 1, CreatedEvent{BlobType: blobType, Payload: &payload})
+			}
+			if b.Payload != nil && *b.Payload == payload {
+				return nil
+			}
+			return wrap(aggregateID, b.Sequence+1, DataUpdatedEvent{Payload: &payload})
+		},
+	}
+}
+
 func UpdateTagsCommand(aggregateID ID, tagsToAddOrUpdate Tags, tagsToDelete []string) Command {
 	return Command{
 		ID:          aggregateID,
 		commandType: "UPDATE_TAGS",
+		args:        []interface{}{aggregateID, tagsToAddOrUpdate, tagsToDelete},
 		validator: func(b Blob) error {
 			if err := validateID(b.ID, aggregateID); err != nil {
 				return err
@@ -149,6 +250,7 @@ func DeleteCommand(aggregateID ID) Command {
 	return Command{
 		ID:          aggregateID,
 		commandType: "DELETE",
+		args:        []interface{}{aggregateID},
 		validator: func(b Blob) error {
 			return validateID(b.ID, aggregateID)
 		},
@@ -165,6 +267,7 @@ func RestoreCommand(aggregateID ID) Command {
 	return Command{
 		ID:          aggregateID,
 		commandType: "RESTORE",
+		args:        []interface{}{aggregateID},
 		validator: func(b Blob) error {
 			if err := validateID(b.ID, aggregateID); err != nil {
 				return err
@@ -180,6 +283,99 @@ func RestoreCommand(aggregateID ID) Command {
 	}
 }
 
+// RevertCommand brings the blob back to its version at targetSequence by generating the events that undo every
+// change since then, so a revert is recorded like any other change. targetSequence has to be an earlier version
+// of the blob. The version is found by AggregateRepository.Process along with the blob, so it is found again
+// when the command is retried.
+func RevertCommand(aggregateID ID, targetSequence uint64) Command {
+	return Command{
+		ID:          aggregateID,
+		commandType: "REVERT",
+		args:        []interface{}{aggregateID, targetSequence},
+		resolve: func(ctx context.Context, ar AggregateRepository, b Blob) (Command, error) {
+			if err := validateID(b.ID, aggregateID); err != nil {
+				return Command{}, err
+			}
+			if err := validateRevert(aggregateID, b.Sequence, targetSequence); err != nil {
+				return Command{}, err
+			}
+			target, err := ar.FindAt(ctx, aggregateID, targetSequence)
+			if err != nil {
+				return Command{}, err
+			}
+			return revertCommand(aggregateID, target), nil
+		},
+	}
+}
+
+// revertCommand brings the blob back to target, an earlier version of it.
+func revertCommand(aggregateID ID, target Blob) Command {
+	return Command{
+		ID:          aggregateID,
+		commandType: "REVERT",
+		args:        []interface{}{aggregateID, target.Sequence},
+		validator: func(b Blob) error {
+			if err := validateID(b.ID, aggregateID); err != nil {
+				return err
+			}
+			if target.ID != aggregateID {
+				return commandError(fmt.Sprintf("cannot revert blob %v to a version of blob %v", aggregateID, target.ID))
+			}
+			return validateRevert(aggregateID, b.Sequence, target.Sequence)
+		},
+		eventGenerator: func(b Blob) EventWithMetadataSlice {
+			var events []Event
+
+			if b.Deleted && !target.Deleted {
+				events = append(events, RestoredEvent{})
+			}
+			if !sameData(b, target) {
+				events = append(events, DataUpdatedEvent{Data: target.Data, Payload: target.Payload})
+			}
+
+			var tagsToDelete TagsDeletedEvent
+			tagsToUpdate := make(Tags)
+			tagsToAdd := make(Tags)
+			for key, value := range b.Tags {
+				if targetValue, ok := target.Tags[key]; !ok {
+					tagsToDelete = append(tagsToDelete, key)
+				} else if targetValue != value {
+					tagsToUpdate[key] = targetValue
+				}
+			}
+			for key, value := range target.Tags {
+				if !b.HasTag(key) {
+					tagsToAdd[key] = value
+				}
+			}
+			if len(tagsToDelete) != 0 {
+				sort.Strings(tagsToDelete)
+				events = append(events, tagsToDelete)
+			}
+			if len(tagsToUpdate) != 0 {
+				events = append(events, TagsUpdatedEvent(tagsToUpdate))
+			}
+			if len(tagsToAdd) != 0 {
+				events = append(events, TagsAddedEvent(tagsToAdd))
+			}
+
+			if !b.Deleted && target.Deleted {
+				events = append(events, DeletedEvent{})
+			}
+			return wrap(aggregateID, b.Sequence+1, events...)
+		},
+	}
+}
+
+func validateRevert(aggregateID ID, sequence uint64, targetSequence uint64) error {
+	if targetSequence == 0 || targetSequence >= sequence {
+		msg := fmt.Sprintf("cannot revert blob %v at sequence %d to sequence %d; only earlier versions can be reverted to",
+			aggregateID, sequence, targetSequence)
+		return commandError(msg)
+	}
+	return nil
+}
+
 func validateID(blobID ID, aggregateID ID) error {
 	if aggregateID == "" {
 		return errEmptyID
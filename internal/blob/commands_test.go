@@ -110,3 +110,52 @@ func assertEvents(t *testing.T, actual, expected EventWithMetadataSlice) {
 		t.Fatalf("Expected events %#v but got %#v", expected, actual)
 	}
 }
+
+func TestRevertCommand(t *testing.T) {
+	tests := map[string]struct {
+		Target         Blob
+		Blob           Blob
+		ExpectedEvents EventWithMetadataSlice
+		ExpectedError  error
+	}{
+		"reverting to the current version should be an error": {
+			Target:        Blob{ID: "1", Sequence: 2},
+			Blob:          Blob{ID: "1", Sequence: 2},
+			ExpectedError: errors.New("cannot revert blob 1 at sequence 2 to sequence 2; only earlier versions can be reverted to"),
+		},
+		"reverting to a version of another blob should be an error": {
+			Target:        Blob{ID: "2", Sequence: 1},
+			Blob:          Blob{ID: "1", Sequence: 2},
+			ExpectedError: errors.New("cannot revert blob 1 to a version of blob 2"),
+		},
+		"reverting data and tags should undo the changes": {
+			Target: Blob{ID: "1", Sequence: 2, Data: []byte("old"), Tags: Tags{"keep": "v", "update": "old", "readd": "v"}},
+			Blob:   Blob{ID: "1", Sequence: 5, Data: []byte("new"), Tags: Tags{"keep": "v", "update": "new", "added": "v"}},
+			ExpectedEvents: wrap("1", 6,
+				DataUpdatedEvent{Data: []byte("old")},
+				TagsDeletedEvent{"added"},
+				TagsUpdatedEvent{"update": "old"},
+				TagsAddedEvent{"readd": "v"}),
+		},
+		"reverting a deleted blob should restore it": {
+			Target:         Blob{ID: "1", Sequence: 1, Data: []byte("old")},
+			Blob:           Blob{ID: "1", Sequence: 3, Data: []byte("old"), Deleted: true},
+			ExpectedEvents: wrap("1", 4, RestoredEvent{}),
+		},
+		"reverting to a deleted version should delete the blob": {
+			Target:         Blob{ID: "1", Sequence: 2, Deleted: true},
+			Blob:           Blob{ID: "1", Sequence: 3},
+			ExpectedEvents: wrap("1", 4, DeletedEvent{}),
+		},
+	}
+
+	for testName, data := range tests {
+		t.Run(testName, func(t *testing.T) {
+			cmd := revertCommand("1", data.Target)
+			events, err := cmd.GenerateEvents(data.Blob)
+
+			assertError(t, err, data.ExpectedError)
+			assertEvents(t, events, data.ExpectedEvents)
+		})
+	}
+}
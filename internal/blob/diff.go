@@ -0,0 +1,212 @@
+package blob
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"mime"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// maxTextDiffLines is the most lines a version can have for its data to be diffed line by line.
+const maxTextDiffLines = 2000
+
+// Diff describes what changed between two versions of a blob. Only the parts that changed are set.
+type Diff struct {
+	ID           `json:"id"`
+	FromSequence uint64               `json:"fromSequence"`
+	ToSequence   uint64               `json:"toSequence"`
+	BlobType     *BlobTypeChange      `json:"blobType,omitempty"`
+	Data         *DataChange          `json:"data,omitempty"`
+	TagsAdded    Tags                 `json:"tagsAdded,omitempty"`
+	TagsRemoved  Tags                 `json:"tagsRemoved,omitempty"`
+	TagsChanged  map[string]TagChange `json:"tagsChanged,omitempty"`
+	Deleted      *DeletedChange       `json:"deleted,omitempty"`
+}
+
+type BlobTypeChange struct {
+	From BlobType `json:"from"`
+	To   BlobType `json:"to"`
+}
+
+// DataChange describes changed data by its size and SHA-256 digest in both versions. Lines is the line by line
+// diff of text data when it was asked for.
+type DataChange struct {
+	FromSize   int64      `json:"fromSize"`
+	ToSize     int64      `json:"toSize"`
+	FromDigest string     `json:"fromDigest"`
+	ToDigest   string     `json:"toDigest"`
+	Lines      []LineDiff `json:"lines,omitempty"`
+}
+
+// LineDiff is a line of text data that is in both versions (Op " "), only in the from version (Op "-") or
+// only in the to version (Op "+").
+type LineDiff struct {
+	Op   string `json:"op"`
+	Text string `json:"text"`
+}
+
+type TagChange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type DeletedChange struct {
+	From bool `json:"from"`
+	To   bool `json:"to"`
+}
+
+// IsEmpty is true if nothing changed between the versions.
+func (d Diff) IsEmpty() bool {
+	return d.BlobType == nil && d.Data == nil && len(d.TagsAdded) == 0 && len(d.TagsRemoved) == 0 &&
+		len(d.TagsChanged) == 0 && d.Deleted == nil
+}
+
+// Diff finds the versions of the aggregate at fromSequence and toSequence and returns what changed between them.
+// With textDiff the data of text blob types is also diffed line by line.
+func (ar AggregateRepository) Diff(ctx context.Context, id ID, fromSequence uint64, toSequence uint64, textDiff bool) (Diff, error) {
+	from, err := ar.FindAt(ctx, id, fromSequence)
+	if err != nil {
+		return Diff{}, errors.Wrapf(err, "cannot find the version to diff from")
+	}
+	to, err := ar.FindAt(ctx, id, toSequence)
+	if err != nil {
+		return Diff{}, errors.Wrapf(err, "cannot find the version to diff to")
+	}
+	if textDiff && !sameData(from, to) && isText(from.BlobType) && isText(to.BlobType) {
+		if from.Data, err = ar.ReadData(ctx, from); err != nil {
+			return Diff{}, errors.Wrapf(err, "cannot read the data to diff from")
+		}
+		if to.Data, err = ar.ReadData(ctx, to); err != nil {
+			return Diff{}, errors.Wrapf(err, "cannot read the data to diff to")
+		}
+	}
+	return DiffBlobs(from, to, textDiff), nil
+}
+
+// DiffBlobs returns what changed from one version of a blob to another.
+func DiffBlobs(from Blob, to Blob, textDiff bool) Diff {
+	diff := Diff{ID: to.ID, FromSequence: from.Sequence, ToSequence: to.Sequence}
+
+	if from.BlobType != to.BlobType {
+		diff.BlobType = &BlobTypeChange{From: from.BlobType, To: to.BlobType}
+	}
+	if !sameData(from, to) {
+		diff.Data = &DataChange{}
+		diff.Data.FromDigest, diff.Data.FromSize = dataDigest(from)
+		diff.Data.ToDigest, diff.Data.ToSize = dataDigest(to)
+		if textDiff && isText(from.BlobType) && isText(to.BlobType) {
+			diff.Data.Lines = diffLines(from.Data, to.Data)
+		}
+	}
+	if from.Deleted != to.Deleted {
+		diff.Deleted = &DeletedChange{From: from.Deleted, To: to.Deleted}
+	}
+
+	for key, value := range from.Tags {
+		if toValue, ok := to.Tags[key]; !ok {
+			if diff.TagsRemoved == nil {
+				diff.TagsRemoved = make(Tags)
+			}
+			diff.TagsRemoved[key] = value
+		} else if toValue != value {
+			if diff.TagsChanged == nil {
+				diff.TagsChanged = make(map[string]TagChange)
+			}
+			diff.TagsChanged[key] = TagChange{From: value, To: toValue}
+		}
+	}
+	for key, value := range to.Tags {
+		if !from.HasTag(key) {
+			if diff.TagsAdded == nil {
+				diff.TagsAdded = make(Tags)
+			}
+			diff.TagsAdded[key] = value
+		}
+	}
+	return diff
+}
+
+// dataDigest returns the digest and size of the data of the blob, whether it is held by the blob or referred to.
+func dataDigest(b Blob) (string, int64) {
+	if b.Payload != nil {
+		return b.Payload.Digest, b.Payload.Size
+	}
+	return digest(b.Data), int64(len(b.Data))
+}
+
+func digest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func sameData(a Blob, b Blob) bool {
+	if a.Payload == nil && b.Payload == nil {
+		return bytes.Equal(a.Data, b.Data)
+	}
+	aDigest, aSize := dataDigest(a)
+	bDigest, bSize := dataDigest(b)
+	return aDigest == bDigest && aSize == bSize
+}
+
+func isText(blobType BlobType) bool {
+	mediaType, _, err := mime.ParseMediaType(blobType.String())
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(mediaType, "text/") || mediaType == "application/json" || mediaType == "application/xml"
+}
+
+// diffLines returns the line by line diff of from and to using their longest common subsequence of lines, or nil
+// if either has more than maxTextDiffLines lines.
+func diffLines(from []byte, to []byte) []LineDiff {
+	a, b := splitLines(from), splitLines(to)
+	if len(a) > maxTextDiffLines || len(b) > maxTextDiffLines {
+		return nil
+	}
+
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var lines []LineDiff
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			lines = append(lines, LineDiff{Op: " ", Text: a[i]})
+			i++
+			j++
+		case j < len(b) && (i == len(a) || lcs[i][j+1] > lcs[i+1][j]):
+			lines = append(lines, LineDiff{Op: "+", Text: b[j]})
+			j++
+		default:
+			lines = append(lines, LineDiff{Op: "-", Text: a[i]})
+			i++
+		}
+	}
+	return lines
+}
+
+func splitLines(data []byte) []string {
+	if len(data) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
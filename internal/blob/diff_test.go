@@ -0,0 +1,41 @@
+package blob
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffBlobs(t *testing.T) {
+	from := Blob{ID: "1", BlobType: "text/plain", Data: []byte("a\nb\nc\n"), Sequence: 2, Tags: Tags{"keep": "v", "change": "old", "remove": "v"}}
+	to := Blob{ID: "1", BlobType: "text/plain", Data: []byte("a\nc\nd\n"), Sequence: 5, Deleted: true, Tags: Tags{"keep": "v", "change": "new", "add": "v"}}
+
+	diff := DiffBlobs(from, to, true)
+
+	expected := Diff{
+		ID:           "1",
+		FromSequence: 2,
+		ToSequence:   5,
+		Data: &DataChange{
+			FromSize:   6,
+			ToSize:     6,
+			FromDigest: digest(from.Data),
+			ToDigest:   digest(to.Data),
+			Lines:      []LineDiff{{" ", "a"}, {"-", "b"}, {" ", "c"}, {"+", "d"}},
+		},
+		TagsAdded:   Tags{"add": "v"},
+		TagsRemoved: Tags{"remove": "v"},
+		TagsChanged: map[string]TagChange{"change": {From: "old", To: "new"}},
+		Deleted:     &DeletedChange{From: false, To: true},
+	}
+	if !reflect.DeepEqual(diff, expected) {
+		t.Fatalf("Expected diff %#v but got %#v", expected, diff)
+	}
+
+	if diff := DiffBlobs(to, to, true); !diff.IsEmpty() {
+		t.Fatalf("Expected an empty diff between the same versions but got %#v", diff)
+	}
+	binary := Blob{BlobType: "application/octet-stream", Data: []byte("a")}
+	if diff := DiffBlobs(binary, Blob{BlobType: binary.BlobType, Data: []byte("b")}, true); diff.Data.Lines != nil {
+		t.Fatalf("Expected binary data not to be diffed line by line but got %#v", diff.Data.Lines)
+	}
+}
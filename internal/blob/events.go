@@ -1,15 +1,42 @@
 package blob
 
+import "time"
+
 type EventWithMetadata struct {
 	ID
 	Sequence uint64
+	// Position orders the event among the events of all aggregates in an EventStore. It is assigned by Persist.
+	Position uint64
+	Metadata
 	Event
 }
 
+// Metadata records when, why and on whose behalf an event was persisted.
+type Metadata struct {
+	EventID    string    `json:"eventId,omitempty"`
+	RecordedAt time.Time `json:"recordedAt"`
+	// CorrelationID groups all events caused by the same request.
+	CorrelationID string `json:"correlationId,omitempty"`
+	// CausationID identifies the request or event that caused this event.
+	CausationID string `json:"causationId,omitempty"`
+	Actor       string `json:"actor,omitempty"`
+	// IdempotencyKey identifies the request that caused the event so a retry of the request is not processed again.
+	IdempotencyKey string `json:"idempotencyKey,omitempty"`
+	// IdempotencyFingerprint identifies the command with the IdempotencyKey, so the key cannot be reused by a
+	// different command. It is recorded by AggregateRepository.Process.
+	IdempotencyFingerprint string            `json:"idempotencyFingerprint,omitempty"`
+	Headers                map[string]string `json:"headers,omitempty"`
+}
+
 func (e EventWithMetadata) Apply(b Blob) Blob {
 	appliedBlob := e.Event.Apply(b)
 	appliedBlob.ID = e.ID
 	appliedBlob.Sequence = e.Sequence
+	if _, ok := e.Event.(CreatedEvent); ok {
+		appliedBlob.CreatedAt = e.RecordedAt
+	}
+	appliedBlob.UpdatedAt = e.RecordedAt
+	appliedBlob.UpdatedBy = e.Actor
 	return appliedBlob
 }
 
@@ -35,21 +62,25 @@ type Event interface {
 	Apply(Blob) Blob
 }
 
+// CreatedEvent and DataUpdatedEvent either hold their data in Data or refer to it in a PayloadStore with Payload.
 type CreatedEvent struct {
 	BlobType
-	Data []byte
+	Data    []byte
+	Payload *PayloadRef `json:",omitempty"`
 }
 
 func (c CreatedEvent) Apply(Blob) Blob {
-	return Blob{BlobType: c.BlobType, Data: c.Data}
+	return Blob{BlobType: c.BlobType, Data: c.Data, Payload: c.Payload}
 }
 
 type DataUpdatedEvent struct {
-	Data []byte
+	Data    []byte
+	Payload *PayloadRef `json:",omitempty"`
 }
 
 func (u DataUpdatedEvent) Apply(b Blob) Blob {
 	b.Data = u.Data
+	b.Payload = u.Payload
 	return b
 }
 
@@ -108,3 +139,23 @@ func (r RestoredEvent) Apply(b Blob) Blob {
 	b.Deleted = false
 	return b
 }
+
+// ChangedTags returns the tags added, updated or deleted by event. Deleted tags have an empty value.
+func ChangedTags(event Event) Tags {
+	changed := make(Tags)
+	switch e := event.(type) {
+	case TagsAddedEvent:
+		for k, v := range e {
+			changed[k] = v
+		}
+	case TagsUpdatedEvent:
+		for k, v := range e {
+			changed[k] = v
+		}
+	case TagsDeletedEvent:
+		for _, k := range e {
+			changed[k] = ""
+		}
+	}
+	return changed
+}
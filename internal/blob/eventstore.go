@@ -4,15 +4,9 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"os"
-	"path"
-	"path/filepath"
+	"math"
 	"sort"
-	"strconv"
 	"sync"
-
-	"github.com/pkg/errors"
 )
 
 // EventStore can store and retrieve events for aggregate ID.
@@ -21,12 +15,33 @@ type EventStore interface {
 	// If events cannot be found for the aggregate ID we return an error with IsMissingAggregate() true.
 	Find(context.Context, ID) (EventWithMetadataSlice, error)
 
-	// Persist events for an aggregate ID.
-	Persist(context.Context, ID, EventWithMetadataSlice) error
+	// FindFrom finds the events for the aggregate ID with a sequence of at least fromSequence.
+	// If the aggregate ID has no events at all we return an error with IsMissingAggregate() true.
+	FindFrom(ctx context.Context, id ID, fromSequence uint64) (EventWithMetadataSlice, error)
+
+	// FindRange finds the events for the aggregate ID with a sequence between fromSequence and toSequence, inclusive.
+	// If the aggregate ID has no events at all we return an error with IsMissingAggregate() true.
+	FindRange(ctx context.Context, id ID, fromSequence uint64, toSequence uint64) (EventWithMetadataSlice, error)
+
+	// ReadAll reads up to limit events of all aggregates in the order they were persisted, starting with the event
+	// at fromPosition. Positions start at 1. A limit of 0 reads all events.
+	ReadAll(ctx context.Context, fromPosition uint64, limit int) (EventWithMetadataSlice, error)
+
+	// LastPosition returns the position of the last persisted event or 0 if there are no events.
+	LastPosition(ctx context.Context) (uint64, error)
+
+	// Persist events for an aggregate ID and assign them the next positions.
+	// expectedVersion is the sequence of the last event the caller has seen for the aggregate, 0 for a new aggregate.
+	// If the stored events have moved past expectedVersion we return an error with IsConcurrencyConflict() true.
+	Persist(ctx context.Context, id ID, expectedVersion uint64, events EventWithMetadataSlice) error
+
+	// Changed returns a channel that is closed once events are persisted after the call.
+	Changed() <-chan struct{}
 }
 
 type eventStoreError struct {
-	isMissingAggregate bool
+	isMissingAggregate    bool
+	isConcurrencyConflict bool
 	error
 }
 
@@ -34,172 +49,169 @@ func (e eventStoreError) IsMissingAggregate() bool {
 	return e.isMissingAggregate
 }
 
-type InMemoryEventStore struct {
-	mux        *sync.Mutex
-	eventStore map[ID]EventWithMetadataSlice
-}
-
-func NewInMemoryEventStore() *InMemoryEventStore {
-	return &InMemoryEventStore{mux: new(sync.Mutex), eventStore: make(map[ID]EventWithMetadataSlice)}
+func (e eventStoreError) IsConcurrencyConflict() bool {
+	return e.isConcurrencyConflict
 }
 
-func (i *InMemoryEventStore) Find(ctx context.Context, id ID) (EventWithMetadataSlice, error) {
-	i.mux.Lock()
-	defer i.mux.Unlock()
-	return i.eventStore[id], nil
+func concurrencyConflictError(id ID, expectedVersion uint64, actualVersion uint64) error {
+	return eventStoreError{
+		isConcurrencyConflict: true,
+		error: fmt.Errorf("cannot persist events for id %v: expected version %d but found version %d",
+			id, expectedVersion, actualVersion)}
 }
 
-func (i *InMemoryEventStore) Persist(ctx context.Context, id ID, events EventWithMetadataSlice) error {
-	i.mux.Lock()
-	defer i.mux.Unlock()
-
-	seenSequences := make(map[uint64]bool)
-	for _, existingEvents := range i.eventStore[id] {
-		seenSequences[existingEvents.Sequence] = true
-	}
-
-	for _, event := range events {
+// validateEvents checks that events belong to the aggregate id and continue the stream from expectedVersion.
+func validateEvents(id ID, expectedVersion uint64, events EventWithMetadataSlice) error {
+	for i, event := range events {
 		if event.ID != id {
 			return fmt.Errorf("cannot persist event %v as it does not have a matching aggregateID %v", event, id)
 		}
-		if seenSequences[event.Sequence] {
-			return fmt.Errorf("cannot persist event %v as an event with the same sequence already exists", event)
+		if event.Sequence != expectedVersion+uint64(i)+1 {
+			return fmt.Errorf("cannot persist event %v as its sequence does not follow version %d", event, expectedVersion)
 		}
 	}
-
-	i.eventStore[id] = append(i.eventStore[id], events...)
 	return nil
 }
 
-type LocalFileSystemEventStore struct {
-	mux           *sync.Mutex
-	baseDirectory string
+type InMemoryEventStore struct {
+	*notifier
+	mux        *sync.Mutex
+	eventStore map[ID]EventWithMetadataSlice
+	all        EventWithMetadataSlice
 }
 
-func NewLocalFileSystemEventStore(baseDirectory string) *LocalFileSystemEventStore {
-	return &LocalFileSystemEventStore{mux: new(sync.Mutex), baseDirectory: baseDirectory}
+func NewInMemoryEventStore() *InMemoryEventStore {
+	return &InMemoryEventStore{notifier: newNotifier(), mux: new(sync.Mutex), eventStore: make(map[ID]EventWithMetadataSlice)}
 }
 
-func (l *LocalFileSystemEventStore) Find(ctx context.Context, id ID) (EventWithMetadataSlice, error) {
-	l.mux.Lock()
-	defer l.mux.Unlock()
+func (i *InMemoryEventStore) Find(ctx context.Context, id ID) (EventWithMetadataSlice, error) {
+	return i.FindRange(ctx, id, 0, math.MaxUint64)
+}
+
+func (i *InMemoryEventStore) FindFrom(ctx context.Context, id ID, fromSequence uint64) (EventWithMetadataSlice, error) {
+	return i.FindRange(ctx, id, fromSequence, math.MaxUint64)
+}
+
+func (i *InMemoryEventStore) FindRange(ctx context.Context, id ID, fromSequence uint64, toSequence uint64) (EventWithMetadataSlice, error) {
+	i.mux.Lock()
+	defer i.mux.Unlock()
 
-	var events EventWithMetadataSlice
-	dirPath := path.Join(l.baseDirectory, id.String())
-	if _, err := os.Stat(dirPath); os.IsNotExist(err) {
+	events, ok := i.eventStore[id]
+	if !ok {
 		return nil, eventStoreError{
 			isMissingAggregate: true,
-			error:              fmt.Errorf("cannot find events directory for id %v in eventstore", id)}
+			error:              fmt.Errorf("cannot find events for id %v in eventstore", id)}
 	}
-	err := filepath.Walk(dirPath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if info.IsDir() {
-			return nil
-		}
-		data, err := ioutil.ReadFile(path)
-		if err != nil {
-			return err
-		}
-		event, err := unmarshal(data)
-		if err != nil {
-			return err
-		}
-		events = append(events, event)
-		return nil
-	})
-
-	sort.Slice(events, func(i, j int) bool {
-		return events[i].Sequence < events[j].Sequence
-	})
+	from, to := sequenceRange(len(events), func(i int) uint64 { return events[i].Sequence }, fromSequence, toSequence)
+	return append(EventWithMetadataSlice(nil), events[from:to]...), nil
+}
 
-	return events, err
+// sequenceRange returns the indexes [from, to) of the items, sorted by sequence, with a sequence between
+// fromSequence and toSequence inclusive.
+func sequenceRange(n int, sequence func(int) uint64, fromSequence uint64, toSequence uint64) (int, int) {
+	from := sort.Search(n, func(i int) bool { return sequence(i) >= fromSequence })
+	to := sort.Search(n, func(i int) bool { return sequence(i) > toSequence })
+	if to < from {
+		to = from
+	}
+	return from, to
 }
 
-func (l *LocalFileSystemEventStore) Persist(ctx context.Context, id ID, events EventWithMetadataSlice) error {
-	l.mux.Lock()
-	defer l.mux.Unlock()
+func (i *InMemoryEventStore) Persist(ctx context.Context, id ID, expectedVersion uint64, events EventWithMetadataSlice) error {
+	i.mux.Lock()
+	defer i.mux.Unlock()
 
-	for _, event := range events {
-		if event.ID != id {
-			return fmt.Errorf("cannot persist event %v as it does not have a matching aggregateID %v", event, id)
-		}
+	var currentVersion uint64
+	if existingEvents := i.eventStore[id]; len(existingEvents) != 0 {
+		currentVersion = existingEvents[len(existingEvents)-1].Sequence
 	}
-
-	dirPath := path.Join(l.baseDirectory, id.String())
-	if err := os.MkdirAll(dirPath, 0755); err != nil {
-		return errors.Wrap(err, "cannot create directory for persisting events")
+	if currentVersion != expectedVersion {
+		return concurrencyConflictError(id, expectedVersion, currentVersion)
+	}
+	if err := validateEvents(id, expectedVersion, events); err != nil {
+		return err
 	}
 
 	for _, event := range events {
-		data, err := marshal(event)
-		if err != nil {
-			return errors.Wrapf(err, "cannot marshal event to persist %v", event)
-		}
-		err = ioutil.WriteFile(path.Join(dirPath, strconv.FormatUint(event.Sequence, 10)), data, 0755)
-		if err != nil {
-			return errors.Wrapf(err, "cannot persist event %v: %v", event)
-		}
+		event.Position = uint64(len(i.all)) + 1
+		i.eventStore[id] = append(i.eventStore[id], event)
+		i.all = append(i.all, event)
+	}
+	if len(events) != 0 {
+		i.notify()
 	}
 	return nil
 }
 
-func marshal(event EventWithMetadata) ([]byte, error) {
-	var eventType string
-	switch event.Event.(type) {
-	case CreatedEvent:
-		eventType = "CE"
-	case DataUpdatedEvent:
-		eventType = "DUE"
-	case TagsAddedEvent:
-		eventType = "TAE"
-	case TagsUpdatedEvent:
-		eventType = "TUE"
-	case TagsDeletedEvent:
-		eventType = "TDE"
-	case DeletedEvent:
-		eventType = "DE"
-	case RestoredEvent:
-		eventType = "RE"
+func (i *InMemoryEventStore) ReadAll(ctx context.Context, fromPosition uint64, limit int) (EventWithMetadataSlice, error) {
+	i.mux.Lock()
+	defer i.mux.Unlock()
+
+	from, to := positionRange(uint64(len(i.all)), fromPosition, limit)
+	return append(EventWithMetadataSlice(nil), i.all[from:to]...), nil
+}
+
+func (i *InMemoryEventStore) LastPosition(ctx context.Context) (uint64, error) {
+	i.mux.Lock()
+	defer i.mux.Unlock()
+	return uint64(len(i.all)), nil
+}
+
+// positionRange returns the indexes [from, to) of up to limit items starting at fromPosition in a log of
+// length items whose positions start at 1.
+func positionRange(length uint64, fromPosition uint64, limit int) (uint64, uint64) {
+	from := fromPosition
+	if from > 0 {
+		from--
 	}
-	marshaledEvent, err := json.Marshal(event.Event)
-	if err != nil {
-		return nil, err
+	if from > length {
+		from = length
 	}
-	return json.Marshal(persistableEvent{event.ID, event.Sequence, eventType, marshaledEvent})
+	to := length
+	if limit > 0 && from+uint64(limit) < to {
+		to = from + uint64(limit)
+	}
+	return from, to
 }
 
-func unmarshal(data []byte) (EventWithMetadata, error) {
-	var pe persistableEvent
-	if err := json.Unmarshal(data, &pe); err != nil {
-		return EventWithMetadata{}, err
-	}
-	var event Event
-	switch pe.EventType {
-	case "CE":
-		event = &CreatedEvent{}
-	case "DUE":
-		event = &DataUpdatedEvent{}
-	case "TAE":
-		event = &TagsAddedEvent{}
-	case "TUE":
-		event = &TagsUpdatedEvent{}
-	case "TDE":
-		event = &TagsDeletedEvent{}
-	case "DE":
-		event = &DeletedEvent{}
-	case "RE":
-		event = &RestoredEvent{}
+// EventStoreOption configures an event store that marshals events, such as a LocalFileSystemEventStore or a
+// SegmentedLogEventStore.
+type EventStoreOption func(*eventStoreOptions)
+
+type eventStoreOptions struct {
+	registry *EventRegistry
+}
+
+// WithEventRegistry marshals and unmarshals events with registry instead of DefaultEventRegistry.
+func WithEventRegistry(registry *EventRegistry) EventStoreOption {
+	return func(o *eventStoreOptions) {
+		o.registry = registry
 	}
+}
 
-	err := json.Unmarshal(pe.MarshaledEvent, event)
-	return EventWithMetadata{ID: pe.ID, Sequence: pe.Sequence, Event: event}, err
+func newEventStoreOptions(opts []EventStoreOption) eventStoreOptions {
+	o := eventStoreOptions{registry: DefaultEventRegistry}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
 }
 
 type persistableEvent struct {
-	ID             `json:"id"`
-	Sequence       uint64          `json:"sequence"`
-	EventType      string          `json:"eventType"`
+	ID       `json:"id"`
+	Sequence uint64 `json:"sequence"`
+	Position uint64 `json:"position,omitempty"`
+	Metadata
+	EventType string `json:"eventType"`
+	// SchemaVersion is the EventType.SchemaVersion the event was marshaled with. Events persisted before
+	// schema versions were introduced do not have one and are version 1.
+	SchemaVersion  int             `json:"schemaVersion,omitempty"`
 	MarshaledEvent json.RawMessage `json:"marshaledEvent"`
 }
+
+func (pe persistableEvent) schemaVersion() int {
+	if pe.SchemaVersion == 0 {
+		return 1
+	}
+	return pe.SchemaVersion
+}
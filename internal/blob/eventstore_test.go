@@ -0,0 +1,198 @@
+package blob
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/venkssa/eventsourcing/internal/platform"
+)
+
+// withEventStores runs test against every EventStore implementation.
+func withEventStores(t *testing.T, test func(t *testing.T, store EventStore)) {
+	dir, err := ioutil.TempDir("", "eventstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	segmentedLog, err := NewSegmentedLogEventStore(path.Join(dir, "segmented"), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer segmentedLog.Close()
+
+	localFileSystem, err := NewLocalFileSystemEventStore(path.Join(dir, "fs"), FsyncAlways)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stores := map[string]EventStore{
+		"InMemoryEventStore":        NewInMemoryEventStore(),
+		"LocalFileSystemEventStore": localFileSystem,
+		"SegmentedLogEventStore":    segmentedLog,
+	}
+	for storeName, store := range stores {
+		t.Run(storeName, func(t *testing.T) {
+			test(t, store)
+		})
+	}
+}
+
+// positioned returns a copy of events with positions starting at from.
+func positioned(events EventWithMetadataSlice, from uint64) EventWithMetadataSlice {
+	positionedEvents := make(EventWithMetadataSlice, len(events))
+	for i, event := range events {
+		event.Position = from + uint64(i)
+		positionedEvents[i] = event
+	}
+	return positionedEvents
+}
+
+func TestEventStorePersistWithExpectedVersion(t *testing.T) {
+	withEventStores(t, func(t *testing.T, store EventStore) {
+		ctx := context.Background()
+
+		if err := store.Persist(ctx, "1", 0, wrap("1", 1, CreatedEvent{BlobType: "text/plain"})); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Persist(ctx, "1", 1, wrap("1", 2, DataUpdatedEvent{Data: []byte("first")})); err != nil {
+			t.Fatal(err)
+		}
+
+		err := store.Persist(ctx, "1", 1, wrap("1", 2, DataUpdatedEvent{Data: []byte("second")}))
+		if !platform.IsConcurrencyConflict(err) {
+			t.Fatalf("Expected a concurrency conflict but got '%v'", err)
+		}
+
+		err = store.Persist(ctx, "1", 2, wrap("1", 4, DeletedEvent{}))
+		if err == nil || platform.IsConcurrencyConflict(err) {
+			t.Fatalf("Expected an error for a sequence gap but got '%v'", err)
+		}
+
+		events, err := store.Find(ctx, "1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(events) != 2 {
+			t.Fatalf("Expected 2 events but got %#v", events)
+		}
+	})
+}
+
+func TestEventStoreFindRange(t *testing.T) {
+	withEventStores(t, func(t *testing.T, store EventStore) {
+		ctx := context.Background()
+		batches := []EventWithMetadataSlice{
+			wrap("1", 1, CreatedEvent{BlobType: "text/plain"}),
+			wrap("1", 2, TagsAddedEvent{"a": "b"}, TagsUpdatedEvent{"c": "d"}),
+			wrap("1", 4, DeletedEvent{}),
+			wrap("1", 5, RestoredEvent{}),
+		}
+		var all EventWithMetadataSlice
+		for _, batch := range batches {
+			if err := store.Persist(ctx, "1", uint64(len(all)), batch); err != nil {
+				t.Fatal(err)
+			}
+			all = append(all, batch...)
+		}
+		all = positioned(all, 1)
+
+		tests := []struct {
+			from, to uint64
+			expected EventWithMetadataSlice
+		}{
+			{from: 1, to: 5, expected: all},
+			{from: 3, to: 4, expected: all[2:4]},
+			{from: 2, to: 2, expected: all[1:2]},
+			{from: 5, to: 9, expected: all[4:]},
+			{from: 4, to: 3, expected: nil},
+			{from: 6, to: 9, expected: nil},
+		}
+		for _, test := range tests {
+			events, err := store.FindRange(ctx, "1", test.from, test.to)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(events) != 0 || len(test.expected) != 0 {
+				assertEvents(t, events, test.expected)
+			}
+		}
+
+		events, err := store.FindFrom(ctx, "1", 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEvents(t, events, all[2:])
+
+		if _, err := store.Find(ctx, "2"); !platform.IsMissingAggregate(err) {
+			t.Fatalf("Expected the events of a missing aggregate to be missing but got '%v'", err)
+		}
+		if _, err := store.FindRange(ctx, "2", 6, 9); !platform.IsMissingAggregate(err) {
+			t.Fatalf("Expected a range of a missing aggregate to be missing but got '%v'", err)
+		}
+	})
+}
+
+func TestEventStoreReadAll(t *testing.T) {
+	withEventStores(t, func(t *testing.T, store EventStore) {
+		ctx := context.Background()
+		batches := []EventWithMetadataSlice{
+			wrap("1", 1, CreatedEvent{BlobType: "text/plain"}),
+			wrap("2", 1, CreatedEvent{BlobType: "text/plain"}, TagsAddedEvent{"a": "b"}),
+			wrap("1", 2, DeletedEvent{}),
+			wrap("3", 1, CreatedEvent{BlobType: "text/plain"}),
+		}
+		var all EventWithMetadataSlice
+		for _, batch := range batches {
+			if err := store.Persist(ctx, batch[0].ID, batch[0].Sequence-1, batch); err != nil {
+				t.Fatal(err)
+			}
+			all = append(all, batch...)
+		}
+		all = positioned(all, 1)
+
+		tests := []struct {
+			from     uint64
+			limit    int
+			expected EventWithMetadataSlice
+		}{
+			{from: 0, limit: 0, expected: all},
+			{from: 1, limit: 10, expected: all},
+			{from: 2, limit: 2, expected: all[1:3]},
+			{from: 4, limit: 1, expected: all[3:4]},
+			{from: 5, limit: 0, expected: all[4:]},
+		}
+		for _, test := range tests {
+			events, err := store.ReadAll(ctx, test.from, test.limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertEvents(t, events, test.expected)
+		}
+
+		lastPosition, err := store.LastPosition(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lastPosition != 5 {
+			t.Fatalf("Expected last position 5 but got %d", lastPosition)
+		}
+
+		events, err := store.ReadAll(ctx, 6, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(events) != 0 {
+			t.Fatalf("Expected no events after the last position but got %#v", events)
+		}
+
+		found, err := store.Find(ctx, "1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEvents(t, found, EventWithMetadataSlice{all[0], all[3]})
+	})
+}
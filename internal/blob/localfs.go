@@ -0,0 +1,649 @@
+package blob
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	tempFilePrefix    = ".tmp-"
+	positionsFileName = "positions"
+)
+
+// FsyncPolicy controls when LocalFileSystemEventStore flushes persisted events to stable storage.
+type FsyncPolicy int
+
+const (
+	// FsyncAlways syncs the event file and its directory, and the base directory for a new aggregate, before
+	// Persist returns.
+	FsyncAlways FsyncPolicy = iota
+	// FsyncFile syncs the event file but not its directory entry.
+	FsyncFile
+	// FsyncNever leaves flushing to the operating system.
+	FsyncNever
+)
+
+// ParseFsyncPolicy parses always, file or never into a FsyncPolicy.
+func ParseFsyncPolicy(policy string) (FsyncPolicy, error) {
+	switch policy {
+	case "always":
+		return FsyncAlways, nil
+	case "file":
+		return FsyncFile, nil
+	case "never":
+		return FsyncNever, nil
+	}
+	return 0, fmt.Errorf("unknown fsync policy %v", policy)
+}
+
+// LocalFileSystemEventStore stores the events of an aggregate in a directory named after its ID.
+//
+// All events of one Persist are written to a single file named after the sequence of its first event.
+// The file is written under a temporary name and linked into place once complete, so a batch is either
+// entirely visible or not at all. Files written by older versions hold a single event and follow the same naming.
+//
+// The positions file in baseDirectory lists the batches of all aggregates in the order they were persisted
+// and the global position of their first event.
+type LocalFileSystemEventStore struct {
+	*notifier
+	mux           *sync.Mutex
+	baseDirectory string
+	fsyncPolicy   FsyncPolicy
+	registry      *EventRegistry
+
+	positions      []batchPosition
+	positionsSize  int64
+	batchPositions map[ID]map[uint64]uint64
+}
+
+type batchPosition struct {
+	Position uint64 `json:"position"`
+	ID       `json:"id"`
+	Batch    uint64 `json:"batch"`
+	Count    int    `json:"count"`
+}
+
+// NewLocalFileSystemEventStore opens the store in baseDirectory and discards batches left partially
+// written by a previous crash.
+func NewLocalFileSystemEventStore(baseDirectory string, fsyncPolicy FsyncPolicy, opts ...EventStoreOption) (*LocalFileSystemEventStore, error) {
+	l := &LocalFileSystemEventStore{
+		notifier:       newNotifier(),
+		mux:            new(sync.Mutex),
+		baseDirectory:  baseDirectory,
+		fsyncPolicy:    fsyncPolicy,
+		registry:       newEventStoreOptions(opts).registry,
+		batchPositions: make(map[ID]map[uint64]uint64),
+	}
+	if err := os.MkdirAll(baseDirectory, 0755); err != nil {
+		return nil, errors.Wrap(err, "cannot create event store directory")
+	}
+	if err := l.recover(); err != nil {
+		return nil, errors.Wrap(err, "cannot recover event store")
+	}
+	if err := l.loadPositions(); err != nil {
+		return nil, errors.Wrap(err, "cannot load positions")
+	}
+	return l, nil
+}
+
+// recover removes the temporary files of batches that were never linked into place.
+func (l *LocalFileSystemEventStore) recover() error {
+	dirs, err := ioutil.ReadDir(l.baseDirectory)
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		dirPath := path.Join(l.baseDirectory, dir.Name())
+		files, err := ioutil.ReadDir(dirPath)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			if strings.HasPrefix(file.Name(), tempFilePrefix) {
+				if err := os.Remove(path.Join(dirPath, file.Name())); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// loadPositions reads the positions file. Entries for batches that were never linked into place are removed.
+// Stores written before positions were introduced get a positions file ordering their batches by the time
+// their first event was recorded.
+func (l *LocalFileSystemEventStore) loadPositions() error {
+	data, err := ioutil.ReadFile(l.positionsPath())
+	if os.IsNotExist(err) {
+		return l.createPositions()
+	}
+	if err != nil {
+		return err
+	}
+
+	var positions []batchPosition
+	var lineSizes []int64
+	var validSize int64
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		if !strings.HasSuffix(line, "\n") {
+			break
+		}
+		var position batchPosition
+		if err := json.Unmarshal([]byte(line), &position); err != nil {
+			return errors.Wrapf(err, "corrupt position at offset %d", validSize)
+		}
+		positions = append(positions, position)
+		lineSizes = append(lineSizes, int64(len(line)))
+		validSize += int64(len(line))
+	}
+
+	for len(positions) != 0 {
+		last := positions[len(positions)-1]
+		if _, err := os.Stat(l.batchPath(last.ID, last.Batch)); !os.IsNotExist(err) {
+			break
+		}
+		positions = positions[:len(positions)-1]
+		validSize -= lineSizes[len(positions)]
+	}
+	if err := os.Truncate(l.positionsPath(), validSize); err != nil {
+		return err
+	}
+
+	l.positionsSize = validSize
+	for _, position := range positions {
+		l.addPosition(position)
+	}
+	return nil
+}
+
+func (l *LocalFileSystemEventStore) createPositions() error {
+	dirs, err := ioutil.ReadDir(l.baseDirectory)
+	if err != nil {
+		return err
+	}
+	type batch struct {
+		id         ID
+		sequence   uint64
+		count      int
+		recordedAt time.Time
+	}
+	var batches []batch
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		id := ID(dir.Name())
+		sequences, err := listBatches(path.Join(l.baseDirectory, dir.Name()))
+		if err != nil {
+			return err
+		}
+		for _, sequence := range sequences {
+			events, err := l.readBatchFile(l.batchPath(id, sequence))
+			if err != nil {
+				return err
+			}
+			if len(events) != 0 {
+				batches = append(batches, batch{id, sequence, len(events), events[0].RecordedAt})
+			}
+		}
+	}
+	sort.Slice(batches, func(i, j int) bool {
+		if !batches[i].recordedAt.Equal(batches[j].recordedAt) {
+			return batches[i].recordedAt.Before(batches[j].recordedAt)
+		}
+		if batches[i].id != batches[j].id {
+			return batches[i].id < batches[j].id
+		}
+		return batches[i].sequence < batches[j].sequence
+	})
+
+	var positions []batchPosition
+	nextPosition := uint64(1)
+	for _, b := range batches {
+		positions = append(positions, batchPosition{nextPosition, b.id, b.sequence, b.count})
+		nextPosition += uint64(b.count)
+	}
+	return l.appendPositions(positions...)
+}
+
+func (l *LocalFileSystemEventStore) appendPositions(positions ...batchPosition) error {
+	var data []byte
+	for _, position := range positions {
+		line, err := json.Marshal(position)
+		if err != nil {
+			return err
+		}
+		data = append(append(data, line...), '\n')
+	}
+
+	f, err := os.OpenFile(l.positionsPath(), os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteAt(data, l.positionsSize)
+	if err == nil && l.fsyncPolicy != FsyncNever {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Truncate(l.positionsPath(), l.positionsSize)
+		return err
+	}
+
+	l.positionsSize += int64(len(data))
+	for _, position := range positions {
+		l.addPosition(position)
+	}
+	return nil
+}
+
+func (l *LocalFileSystemEventStore) addPosition(position batchPosition) {
+	l.positions = append(l.positions, position)
+	if l.batchPositions[position.ID] == nil {
+		l.batchPositions[position.ID] = make(map[uint64]uint64)
+	}
+	l.batchPositions[position.ID][position.Batch] = position.Position
+}
+
+// nextPosition returns the position of the next persisted event.
+func (l *LocalFileSystemEventStore) nextPosition() uint64 {
+	if len(l.positions) == 0 {
+		return 1
+	}
+	last := l.positions[len(l.positions)-1]
+	return last.Position + uint64(last.Count)
+}
+
+func (l *LocalFileSystemEventStore) positionsPath() string {
+	return path.Join(l.baseDirectory, positionsFileName)
+}
+
+func (l *LocalFileSystemEventStore) batchPath(id ID, batch uint64) string {
+	return path.Join(l.baseDirectory, id.String(), strconv.FormatUint(batch, 10))
+}
+
+// readBatch reads the events of a batch and sets their positions.
+func (l *LocalFileSystemEventStore) readBatch(id ID, batch uint64) (EventWithMetadataSlice, error) {
+	events, err := l.readBatchFile(l.batchPath(id, batch))
+	if err != nil {
+		return nil, err
+	}
+	if position, ok := l.batchPositions[id][batch]; ok {
+		for i := range events {
+			events[i].Position = position + uint64(i)
+		}
+	}
+	return events, nil
+}
+
+func (l *LocalFileSystemEventStore) Find(ctx context.Context, id ID) (EventWithMetadataSlice, error) {
+	return l.FindRange(ctx, id, 0, math.MaxUint64)
+}
+
+func (l *LocalFileSystemEventStore) FindFrom(ctx context.Context, id ID, fromSequence uint64) (EventWithMetadataSlice, error) {
+	return l.FindRange(ctx, id, fromSequence, math.MaxUint64)
+}
+
+// FindRange only reads the batches that can hold events in the range; batch file names give the sequence of
+// their first event.
+func (l *LocalFileSystemEventStore) FindRange(ctx context.Context, id ID, fromSequence uint64, toSequence uint64) (EventWithMetadataSlice, error) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	dirPath := path.Join(l.baseDirectory, id.String())
+	batches, err := listBatches(dirPath)
+	if os.IsNotExist(err) {
+		return nil, eventStoreError{
+			isMissingAggregate: true,
+			error:              fmt.Errorf("cannot find events directory for id %v in eventstore", id)}
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot list events for id %v", id)
+	}
+
+	var events EventWithMetadataSlice
+	for i, batch := range batches {
+		if batch > toSequence {
+			break
+		}
+		if i+1 < len(batches) && batches[i+1] <= fromSequence {
+			continue
+		}
+		batchEvents, err := l.readBatch(id, batch)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot read events for id %v", id)
+		}
+		for _, event := range batchEvents {
+			if event.Sequence >= fromSequence && event.Sequence <= toSequence {
+				events = append(events, event)
+			}
+		}
+	}
+	return events, nil
+}
+
+func (l *LocalFileSystemEventStore) ReadAll(ctx context.Context, fromPosition uint64, limit int) (EventWithMetadataSlice, error) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	first := sort.Search(len(l.positions), func(i int) bool {
+		return l.positions[i].Position+uint64(l.positions[i].Count) > fromPosition
+	})
+
+	var events EventWithMetadataSlice
+	for _, position := range l.positions[first:] {
+		if limit > 0 && len(events) >= limit {
+			break
+		}
+		batchEvents, err := l.readBatch(position.ID, position.Batch)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot read events at position %d", position.Position)
+		}
+		for _, event := range batchEvents {
+			if event.Position >= fromPosition && (limit <= 0 || len(events) < limit) {
+				events = append(events, event)
+			}
+		}
+	}
+	return events, nil
+}
+
+func (l *LocalFileSystemEventStore) LastPosition(ctx context.Context) (uint64, error) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return l.nextPosition() - 1, nil
+}
+
+func (l *LocalFileSystemEventStore) Persist(ctx context.Context, id ID, expectedVersion uint64, events EventWithMetadataSlice) error {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	dirPath := path.Join(l.baseDirectory, id.String())
+	currentVersion, err := l.currentVersion(dirPath)
+	if err != nil {
+		return errors.Wrapf(err, "cannot find current version for id %v", id)
+	}
+	if currentVersion != expectedVersion {
+		return concurrencyConflictError(id, expectedVersion, currentVersion)
+	}
+	if err := validateEvents(id, expectedVersion, events); err != nil {
+		return err
+	}
+	if len(events) == 0 {
+		return nil
+	}
+
+	if err := os.MkdirAll(dirPath, 0755); err != nil {
+		return errors.Wrap(err, "cannot create directory for persisting events")
+	}
+	if expectedVersion == 0 && l.fsyncPolicy == FsyncAlways {
+		// The directory of a new aggregate is only durable once its entry in the base directory is synced.
+		if err := syncDir(l.baseDirectory); err != nil {
+			return errors.Wrap(err, "cannot sync directory for persisting events")
+		}
+	}
+
+	position := batchPosition{Position: l.nextPosition(), ID: id, Batch: events[0].Sequence, Count: len(events)}
+	var data []byte
+	for i, event := range events {
+		event.Position = position.Position + uint64(i)
+		marshaledEvent, err := l.registry.Marshal(event)
+		if err != nil {
+			return errors.Wrapf(err, "cannot marshal event to persist %v", event)
+		}
+		data = append(append(data, marshaledEvent...), '\n')
+	}
+
+	if err := l.writeBatch(dirPath, position, data); err != nil {
+		if os.IsExist(errors.Cause(err)) {
+			return concurrencyConflictError(id, expectedVersion, events[0].Sequence)
+		}
+		return errors.Wrapf(err, "cannot persist events for id %v", id)
+	}
+	l.notify()
+	return nil
+}
+
+// writeBatch writes data to a temporary file, records its position and links it into place, failing if the
+// batch already exists. A crash before the link leaves a position for a missing batch, which loadPositions removes.
+func (l *LocalFileSystemEventStore) writeBatch(dirPath string, position batchPosition, data []byte) error {
+	batchName := strconv.FormatUint(position.Batch, 10)
+	tempFile, err := ioutil.TempFile(dirPath, tempFilePrefix+batchName+"-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+
+	if _, err := tempFile.Write(data); err != nil {
+		tempFile.Close()
+		return err
+	}
+	if l.fsyncPolicy != FsyncNever {
+		if err := tempFile.Sync(); err != nil {
+			tempFile.Close()
+			return err
+		}
+	}
+	if err := tempFile.Close(); err != nil {
+		return err
+	}
+
+	positionsSize := l.positionsSize
+	if err := l.appendPositions(position); err != nil {
+		return err
+	}
+	if err := os.Link(tempFile.Name(), path.Join(dirPath, batchName)); err != nil {
+		l.removeLastPosition(positionsSize)
+		return errors.WithStack(err)
+	}
+	if l.fsyncPolicy == FsyncAlways {
+		return syncDir(dirPath)
+	}
+	return nil
+}
+
+// removeLastPosition undoes the last appendPositions, which left the positions file at positionsSize bytes.
+func (l *LocalFileSystemEventStore) removeLastPosition(positionsSize int64) {
+	last := l.positions[len(l.positions)-1]
+	l.positions = l.positions[:len(l.positions)-1]
+	delete(l.batchPositions[last.ID], last.Batch)
+	l.positionsSize = positionsSize
+	os.Truncate(l.positionsPath(), positionsSize)
+}
+
+func syncDir(dirPath string) error {
+	dir, err := os.Open(dirPath)
+	if err != nil {
+		return err
+	}
+	if err := dir.Sync(); err != nil {
+		dir.Close()
+		return err
+	}
+	return dir.Close()
+}
+
+// listBatches returns the sequences of the batch files in dirPath in ascending order.
+func listBatches(dirPath string) ([]uint64, error) {
+	files, err := ioutil.ReadDir(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	var batches []uint64
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		sequence, err := strconv.ParseUint(file.Name(), 10, 64)
+		if err != nil {
+			continue
+		}
+		batches = append(batches, sequence)
+	}
+	sort.Slice(batches, func(i, j int) bool { return batches[i] < batches[j] })
+	return batches, nil
+}
+
+func (l *LocalFileSystemEventStore) readBatchFile(filename string) (EventWithMetadataSlice, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var events EventWithMetadataSlice
+	decoder := json.NewDecoder(f)
+	for {
+		var data json.RawMessage
+		if err := decoder.Decode(&data); err == io.EOF {
+			return events, nil
+		} else if err != nil {
+			return nil, errors.Wrapf(err, "cannot decode %v", filename)
+		}
+		event, err := l.registry.Unmarshal(data)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot unmarshal event in %v", filename)
+		}
+		events = append(events, event)
+	}
+}
+
+// currentVersion returns the sequence of the last event stored in dirPath or 0 if there are no events.
+func (l *LocalFileSystemEventStore) currentVersion(dirPath string) (uint64, error) {
+	batches, err := listBatches(dirPath)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(batches) == 0 {
+		return 0, nil
+	}
+	events, err := l.readBatchFile(path.Join(dirPath, strconv.FormatUint(batches[len(batches)-1], 10)))
+	if err != nil {
+		return 0, err
+	}
+	if len(events) == 0 {
+		return 0, fmt.Errorf("batch %v in %v has no events", batches[len(batches)-1], dirPath)
+	}
+	return events[len(events)-1].Sequence, nil
+}
+
+// UpgradeEvents rewrites every batch holding an event marshaled with an older schema version so that all events
+// are stored in the latest version registered with the EventRegistry of the store. It returns the number of
+// rewritten batches. It must only run while no other process uses the store.
+func (l *LocalFileSystemEventStore) UpgradeEvents(ctx context.Context) (int, error) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	dirs, err := ioutil.ReadDir(l.baseDirectory)
+	if err != nil {
+		return 0, err
+	}
+	var rewritten int
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		dirPath := path.Join(l.baseDirectory, dir.Name())
+		batches, err := listBatches(dirPath)
+		if err != nil {
+			return rewritten, err
+		}
+		for _, batch := range batches {
+			if err := ctx.Err(); err != nil {
+				return rewritten, err
+			}
+			upgraded, err := l.upgradeBatch(dirPath, strconv.FormatUint(batch, 10))
+			if err != nil {
+				return rewritten, errors.Wrapf(err, "cannot upgrade batch %v of %v", batch, dir.Name())
+			}
+			if upgraded {
+				rewritten++
+			}
+		}
+	}
+	return rewritten, nil
+}
+
+func (l *LocalFileSystemEventStore) upgradeBatch(dirPath string, batchName string) (bool, error) {
+	f, err := os.Open(path.Join(dirPath, batchName))
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	var data []byte
+	latest := true
+	decoder := json.NewDecoder(f)
+	for {
+		var marshaledEvent json.RawMessage
+		if err := decoder.Decode(&marshaledEvent); err == io.EOF {
+			break
+		} else if err != nil {
+			return false, err
+		}
+		isLatest, err := l.registry.IsLatest(marshaledEvent)
+		if err != nil {
+			return false, err
+		}
+		latest = latest && isLatest
+
+		event, err := l.registry.Unmarshal(marshaledEvent)
+		if err != nil {
+			return false, err
+		}
+		if marshaledEvent, err = l.registry.Marshal(event); err != nil {
+			return false, err
+		}
+		data = append(append(data, marshaledEvent...), '\n')
+	}
+	if latest {
+		return false, nil
+	}
+
+	tempFile, err := ioutil.TempFile(dirPath, tempFilePrefix+batchName+"-")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tempFile.Name())
+	if _, err := tempFile.Write(data); err != nil {
+		tempFile.Close()
+		return false, err
+	}
+	if l.fsyncPolicy != FsyncNever {
+		if err := tempFile.Sync(); err != nil {
+			tempFile.Close()
+			return false, err
+		}
+	}
+	if err := tempFile.Close(); err != nil {
+		return false, err
+	}
+	if err := os.Rename(tempFile.Name(), path.Join(dirPath, batchName)); err != nil {
+		return false, err
+	}
+	if l.fsyncPolicy == FsyncAlways {
+		return true, syncDir(dirPath)
+	}
+	return true, nil
+}
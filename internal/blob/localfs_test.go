@@ -0,0 +1,150 @@
+package blob
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestLocalFileSystemEventStoreBatches(t *testing.T) {
+	dir, err := ioutil.TempDir("", "localfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// An event file written before batches and positions were introduced holds a single event.
+	legacy, err := DefaultEventRegistry.Marshal(EventWithMetadata{ID: "1", Sequence: 1, Event: CreatedEvent{BlobType: "text/plain"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.MkdirAll(path.Join(dir, "1"), 0755)
+	if err := ioutil.WriteFile(path.Join(dir, "1", "1"), legacy, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	store, err := NewLocalFileSystemEventStore(dir, FsyncNever)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	batch := wrap("1", 2, TagsUpdatedEvent{"a": "c"}, TagsAddedEvent{"b": "d"})
+	if err := store.Persist(ctx, "1", 1, batch); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a crash before the next batch was linked into place.
+	partial := path.Join(dir, "1", tempFilePrefix+"4-123")
+	if err := ioutil.WriteFile(partial, []byte(`{"id":"1","sequ`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = NewLocalFileSystemEventStore(dir, FsyncNever)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(partial); !os.IsNotExist(err) {
+		t.Fatalf("Expected partial batch to be removed but got '%v'", err)
+	}
+
+	events, err := store.Find(ctx, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := positioned(append(wrap("1", 1, CreatedEvent{BlobType: "text/plain"}), batch...), 1)
+	if !reflect.DeepEqual(events, expected) {
+		t.Fatalf("Expected events %#v but got %#v", expected, events)
+	}
+	if err := store.Persist(ctx, "1", 3, wrap("1", 4, DeletedEvent{})); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLocalFileSystemEventStoreUpgradeEvents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "localfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.MkdirAll(path.Join(dir, "1"), 0755)
+	v1 := `{"id":"1","sequence":1,"eventType":"CE","marshaledEvent":{"BlobType":"text/plain"}}
+{"id":"1","sequence":2,"eventType":"test.versioned","marshaledEvent":{"Title":"hello"}}
+`
+	if err := ioutil.WriteFile(path.Join(dir, "1", "1"), []byte(v1), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := NewLocalFileSystemEventStore(dir, FsyncNever, WithEventRegistry(newVersionedEventRegistry()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	before, err := store.Find(ctx, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for expectedRewrites := 1; expectedRewrites >= 0; expectedRewrites-- {
+		rewritten, err := store.UpgradeEvents(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rewritten != expectedRewrites {
+			t.Fatalf("Expected %d rewritten batches but got %d", expectedRewrites, rewritten)
+		}
+	}
+
+	after, err := store.Find(ctx, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(before, after) || after[1].Event != (versionedEvent{Name: "hello"}) {
+		t.Fatalf("Expected upgraded events %#v but got %#v", before, after)
+	}
+}
+
+func TestLocalFileSystemEventStoreRecoversPositions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "localfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	store, err := NewLocalFileSystemEventStore(dir, FsyncNever)
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := wrap("1", 1, CreatedEvent{BlobType: "text/plain"})
+	if err := store.Persist(ctx, "1", 0, created); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a crash after recording the position of a batch but before linking it into place.
+	f, err := os.OpenFile(path.Join(dir, positionsFileName), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte(`{"position":2,"id":"1","batch":2,"count":1}` + "\n" + `{"posit`))
+	f.Close()
+
+	store, err = NewLocalFileSystemEventStore(dir, FsyncNever)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleted := wrap("1", 2, DeletedEvent{})
+	if err := store.Persist(ctx, "1", 1, deleted); err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := store.ReadAll(ctx, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEvents(t, events, positioned(append(created, deleted...), 1))
+}
@@ -0,0 +1,73 @@
+package blob
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"time"
+)
+
+type metadataKey struct{}
+
+// WithMetadata returns a context carrying the correlation ID, causation ID, actor, idempotency key and headers that
+// AggregateRepository.Process records on the events it persists. EventID and RecordedAt are ignored.
+func WithMetadata(ctx context.Context, md Metadata) context.Context {
+	return context.WithValue(ctx, metadataKey{}, md)
+}
+
+// MetadataFromContext returns the Metadata added to ctx by WithMetadata.
+func MetadataFromContext(ctx context.Context) Metadata {
+	md, _ := ctx.Value(metadataKey{}).(Metadata)
+	return md
+}
+
+// stamp returns a copy of events with metadata from ctx, a new EventID and the current time.
+// Events without a correlation ID in ctx are correlated with the first event.
+func stamp(ctx context.Context, events EventWithMetadataSlice) (EventWithMetadataSlice, error) {
+	md := MetadataFromContext(ctx)
+	recordedAt := time.Now().UTC()
+
+	stamped := make(EventWithMetadataSlice, len(events))
+	for i, event := range events {
+		eventID, err := newUUID()
+		if err != nil {
+			return nil, err
+		}
+		if md.CorrelationID == "" {
+			md.CorrelationID = eventID
+		}
+		event.Metadata = Metadata{
+			EventID:        eventID,
+			RecordedAt:     recordedAt,
+			CorrelationID:  md.CorrelationID,
+			CausationID:    md.CausationID,
+			Actor:          md.Actor,
+			IdempotencyKey: md.IdempotencyKey,
+			Headers:        copyHeaders(md.Headers),
+		}
+		stamped[i] = event
+	}
+	return stamped, nil
+}
+
+func copyHeaders(headers map[string]string) map[string]string {
+	if len(headers) == 0 {
+		return nil
+	}
+	copied := make(map[string]string, len(headers))
+	for k, v := range headers {
+		copied[k] = v
+	}
+	return copied
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() (string, error) {
+	var uuid [16]byte
+	if _, err := rand.Read(uuid[:]); err != nil {
+		return "", fmt.Errorf("cannot generate uuid: %v", err)
+	}
+	uuid[6] = uuid[6]&0x0f | 0x40
+	uuid[8] = uuid[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:]), nil
+}
@@ -0,0 +1,144 @@
+package blob
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// PayloadRef refers to data kept in a PayloadStore by the hex encoded SHA-256 digest and size of the data.
+type PayloadRef struct {
+	Digest string `json:"digest"`
+	Size   int64  `json:"size"`
+}
+
+// PayloadStore keeps the data of blobs apart from their events. Data is addressed by its digest so storing the
+// same data twice keeps a single copy.
+type PayloadStore interface {
+	// Put stores the data read from r and returns a reference to it.
+	Put(ctx context.Context, r io.Reader) (PayloadRef, error)
+
+	// Open opens the data ref refers to.
+	Open(ctx context.Context, ref PayloadRef) (io.ReadSeekCloser, error)
+}
+
+func validateDigest(digest string) error {
+	if decoded, err := hex.DecodeString(digest); err != nil || len(decoded) != sha256.Size {
+		return fmt.Errorf("invalid payload digest %q", digest)
+	}
+	return nil
+}
+
+type bytesPayload struct {
+	*bytes.Reader
+}
+
+func (bytesPayload) Close() error {
+	return nil
+}
+
+type InMemoryPayloadStore struct {
+	mux      *sync.Mutex
+	payloads map[string][]byte
+}
+
+func NewInMemoryPayloadStore() *InMemoryPayloadStore {
+	return &InMemoryPayloadStore{mux: new(sync.Mutex), payloads: make(map[string][]byte)}
+}
+
+func (i *InMemoryPayloadStore) Put(ctx context.Context, r io.Reader) (PayloadRef, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return PayloadRef{}, errors.Wrap(err, "cannot read payload")
+	}
+	sum := sha256.Sum256(data)
+	ref := PayloadRef{Digest: hex.EncodeToString(sum[:]), Size: int64(len(data))}
+
+	i.mux.Lock()
+	defer i.mux.Unlock()
+	i.payloads[ref.Digest] = data
+	return ref, nil
+}
+
+func (i *InMemoryPayloadStore) Open(ctx context.Context, ref PayloadRef) (io.ReadSeekCloser, error) {
+	i.mux.Lock()
+	defer i.mux.Unlock()
+
+	data, ok := i.payloads[ref.Digest]
+	if !ok {
+		return nil, fmt.Errorf("cannot find payload %v", ref.Digest)
+	}
+	return bytesPayload{bytes.NewReader(data)}, nil
+}
+
+// LocalFileSystemPayloadStore stores each payload in a file named after its digest, in a directory named after
+// the first two characters of the digest.
+type LocalFileSystemPayloadStore struct {
+	baseDirectory string
+}
+
+func NewLocalFileSystemPayloadStore(baseDirectory string) (*LocalFileSystemPayloadStore, error) {
+	if err := os.MkdirAll(baseDirectory, 0755); err != nil {
+		return nil, errors.Wrap(err, "cannot create payload directory")
+	}
+	return &LocalFileSystemPayloadStore{baseDirectory: baseDirectory}, nil
+}
+
+// Put writes the data to a temporary file while computing its digest and syncs it before renaming it into place,
+// as events referring to the payload are persisted right after.
+func (l *LocalFileSystemPayloadStore) Put(ctx context.Context, r io.Reader) (PayloadRef, error) {
+	tempFile, err := ioutil.TempFile(l.baseDirectory, tempFilePrefix)
+	if err != nil {
+		return PayloadRef{}, err
+	}
+	defer os.Remove(tempFile.Name())
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tempFile, hash), r)
+	if err == nil {
+		err = tempFile.Sync()
+	}
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return PayloadRef{}, errors.Wrap(err, "cannot write payload")
+	}
+
+	ref := PayloadRef{Digest: hex.EncodeToString(hash.Sum(nil)), Size: size}
+	payloadPath := l.payloadPath(ref.Digest)
+	if _, err := os.Stat(payloadPath); err == nil {
+		return ref, nil
+	}
+	if err := os.MkdirAll(path.Dir(payloadPath), 0755); err != nil {
+		return PayloadRef{}, errors.Wrapf(err, "cannot create directory for payload %v", ref.Digest)
+	}
+	if err := os.Rename(tempFile.Name(), payloadPath); err != nil {
+		return PayloadRef{}, errors.Wrapf(err, "cannot store payload %v", ref.Digest)
+	}
+	return ref, syncDir(path.Dir(payloadPath))
+}
+
+func (l *LocalFileSystemPayloadStore) Open(ctx context.Context, ref PayloadRef) (io.ReadSeekCloser, error) {
+	if err := validateDigest(ref.Digest); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(l.payloadPath(ref.Digest))
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot open payload %v", ref.Digest)
+	}
+	return f, nil
+}
+
+func (l *LocalFileSystemPayloadStore) payloadPath(digest string) string {
+	return path.Join(l.baseDirectory, digest[:2], digest)
+}
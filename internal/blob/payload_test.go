@@ -0,0 +1,102 @@
+package blob
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestLocalFileSystemPayloadStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "payloads")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := NewLocalFileSystemPayloadStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	ref, err := store.Put(ctx, bytes.NewReader([]byte("hello")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := store.Put(ctx, bytes.NewReader([]byte("hello")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref != again || ref.Size != 5 || ref.Digest != digest([]byte("hello")) {
+		t.Fatalf("Expected the same reference to the data but got %v and %v", ref, again)
+	}
+	payloads, err := ioutil.ReadDir(path.Join(dir, ref.Digest[:2]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(payloads) != 1 {
+		t.Fatalf("Expected the data to be stored once but found %d files", len(payloads))
+	}
+
+	f, err := store.Open(ctx, ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello" {
+		t.Fatalf("Expected data hello but got %s", data)
+	}
+	if _, err := store.Open(ctx, PayloadRef{Digest: "../etc"}); err == nil {
+		t.Fatal("Expected an invalid digest to be an error")
+	}
+}
+
+func TestProcessWithPayloads(t *testing.T) {
+	store := NewInMemoryEventStore()
+	repo := NewAggregateRepository(store, WithPayloads(NewInMemoryPayloadStore()))
+	ctx := context.Background()
+
+	for _, cmd := range []Command{
+		CreateCommand("1", "text/plain", []byte("one")),
+		UpdateCommand("1", []byte("two"), false),
+	} {
+		if _, err := repo.Process(ctx, cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := repo.Process(ctx, RevertCommand("1", 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := store.Find(ctx, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, event := range events {
+		if created, ok := event.Event.(CreatedEvent); ok && (created.Data != nil || created.Payload == nil) {
+			t.Fatalf("Expected the event to refer to its data but got %#v", created)
+		}
+		if updated, ok := event.Event.(DataUpdatedEvent); ok && (updated.Data != nil || updated.Payload == nil) {
+			t.Fatalf("Expected the event to refer to its data but got %#v", updated)
+		}
+	}
+
+	blob, err := repo.Find(ctx, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := repo.ReadData(ctx, blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "one" || *blob.Payload != *events[0].Event.(CreatedEvent).Payload {
+		t.Fatalf("Expected the reverted blob to refer to the created data but got %s in %#v", data, blob)
+	}
+}
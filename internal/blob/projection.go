@@ -0,0 +1,624 @@
+package blob
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const projectionBatchSize = 500
+
+// Projection builds a read model from events. Its state, including the position of the last projected event,
+// is kept in a ProjectionState so a Projector can resume and rebuild it.
+type Projection interface {
+	// Name identifies the projection.
+	Name() string
+
+	// Handles returns prototypes of the events the projection handles. Other events are not projected.
+	// A projection that returns no prototypes handles all events.
+	Handles() []Event
+
+	// Project applies the event to the read model in state. Events are projected one at a time in the order
+	// they were persisted.
+	Project(ctx context.Context, state ProjectionState, event EventWithMetadata) error
+}
+
+// ProjectionState is a key value store for the state of a projection and its checkpoint. Values are marshaled
+// as JSON.
+//
+// Get and Keys only see the values as of the checkpoint, so readers of a read model never see changes that may
+// still be discarded. A Projection sees its own changes through the state returned by Pending.
+type ProjectionState interface {
+	// Get unmarshals the value of key into v and returns false if there is no such key.
+	Get(ctx context.Context, key string, v interface{}) (bool, error)
+	Put(ctx context.Context, key string, v interface{}) error
+	Delete(ctx context.Context, key string) error
+	// Keys returns the keys with the prefix in ascending order.
+	Keys(ctx context.Context, prefix string) ([]string, error)
+	// Pending returns the state as changed since the last checkpoint. Its Get and Keys see the changes; all
+	// other methods are those of the state itself.
+	Pending() ProjectionState
+
+	// Checkpoint returns the position of the last projected event or 0 if no event has been projected.
+	Checkpoint(ctx context.Context) (uint64, error)
+	// SaveCheckpoint records position as projected along with all changes to the state made since the previous
+	// checkpoint.
+	SaveCheckpoint(ctx context.Context, position uint64) error
+	// Discard drops the changes to the state made since the last checkpoint.
+	Discard(ctx context.Context) error
+	// Clear removes all keys and the checkpoint.
+	Clear(ctx context.Context) error
+}
+
+// ProjectionStatus describes how far a projection is behind the event store.
+type ProjectionStatus struct {
+	Name         string `json:"name"`
+	Position     uint64 `json:"position"`
+	LastPosition uint64 `json:"lastPosition"`
+	Lag          uint64 `json:"lag"`
+}
+
+// Projector keeps a Projection up to date with the events in an EventStore.
+type Projector struct {
+	store      EventStore
+	projection Projection
+	state      ProjectionState
+	handles    map[reflect.Type]bool
+	// onSkip is called with the events the projection failed to project if they are skipped.
+	onSkip func(EventWithMetadata, error)
+}
+
+type ProjectorOption func(*Projector)
+
+// SkipFailedEvents skips the events the projection fails to project, instead of stopping, after calling onSkip
+// with the event and the error. The read model misses the changes of a skipped event.
+func SkipFailedEvents(onSkip func(event EventWithMetadata, err error)) ProjectorOption {
+	return func(p *Projector) {
+		p.onSkip = onSkip
+	}
+}
+
+func NewProjector(store EventStore, projection Projection, state ProjectionState, opts ...ProjectorOption) *Projector {
+	handles := make(map[reflect.Type]bool)
+	for _, prototype := range projection.Handles() {
+		handles[reflect.TypeOf(prototype)] = true
+	}
+	p := &Projector{store: store, projection: projection, state: state, handles: handles}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+func (p *Projector) Name() string {
+	return p.projection.Name()
+}
+
+// Run projects the events persisted after the checkpoint of the projection until ctx is done or projecting fails.
+// The checkpoint is saved whenever the projection has caught up with the events read so far, or after
+// projectionBatchSize events.
+func (p *Projector) Run(ctx context.Context) error {
+	if err := p.state.Discard(ctx); err != nil {
+		return errors.Wrapf(err, "cannot discard changes of projection %v", p.Name())
+	}
+	checkpoint, err := p.state.Checkpoint(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "cannot load checkpoint of projection %v", p.Name())
+	}
+	subscription, err := Subscribe(ctx, p.store, SubscriptionOptions{
+		FromPosition: checkpoint + 1,
+		BatchSize:    projectionBatchSize,
+		BufferSize:   projectionBatchSize,
+	})
+	if err != nil {
+		return err
+	}
+	defer subscription.Close()
+
+	for event := range subscription.Events() {
+		batch := EventWithMetadataSlice{event}
+	readAhead:
+		for len(batch) < projectionBatchSize {
+			select {
+			case next, ok := <-subscription.Events():
+				if !ok {
+					break readAhead
+				}
+				batch = append(batch, next)
+			default:
+				break readAhead
+			}
+		}
+		if err := p.projectEvents(ctx, batch); err != nil {
+			return err
+		}
+	}
+	if err := subscription.Err(); err != nil {
+		return errors.Wrapf(err, "projection %v stopped", p.Name())
+	}
+	return ctx.Err()
+}
+
+// Rebuild clears the state of the projection and projects all events again. Run must not be running.
+func (p *Projector) Rebuild(ctx context.Context) error {
+	if err := p.state.Clear(ctx); err != nil {
+		return errors.Wrapf(err, "cannot clear projection %v", p.Name())
+	}
+
+	for position := uint64(1); ; {
+		events, err := p.store.ReadAll(ctx, position, projectionBatchSize)
+		if err != nil {
+			return errors.Wrapf(err, "cannot read events from position %d", position)
+		}
+		if len(events) == 0 {
+			return nil
+		}
+		if err := p.projectEvents(ctx, events); err != nil {
+			return err
+		}
+		position = events[len(events)-1].Position + 1
+	}
+}
+
+// projectEvents projects the events that follow the checkpoint into the pending state and saves the position of
+// the last one as the checkpoint. If projecting an event fails, the changes made since the checkpoint are discarded. Unless ctx is
+// done, a failed event is then skipped if SkipFailedEvents is set: the events before it are projected again and
+// the checkpoint is saved past it.
+func (p *Projector) projectEvents(ctx context.Context, events EventWithMetadataSlice) error {
+	checkpoint, err := p.state.Checkpoint(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "cannot load checkpoint of projection %v", p.Name())
+	}
+	pending := p.state.Pending()
+	var projected bool
+	for i, event := range events {
+		if event.Position <= checkpoint {
+			continue
+		}
+		if len(p.handles) == 0 || p.handles[reflect.TypeOf(event.Event)] {
+			if err := p.projection.Project(ctx, pending, event); err != nil {
+				if discardErr := p.state.Discard(ctx); discardErr != nil {
+					return errors.Wrapf(discardErr, "cannot discard changes of projection %v", p.Name())
+				}
+				err = errors.Wrapf(err, "projection %v cannot project event at position %d", p.Name(), event.Position)
+				if p.onSkip == nil || ctx.Err() != nil {
+					return err
+				}
+				if err := p.projectEvents(ctx, events[:i]); err != nil {
+					return err
+				}
+				p.onSkip(event, err)
+				if err := p.state.SaveCheckpoint(ctx, event.Position); err != nil {
+					return errors.Wrapf(err, "cannot save checkpoint of projection %v", p.Name())
+				}
+				return p.projectEvents(ctx, events[i+1:])
+			}
+		}
+		checkpoint, projected = event.Position, true
+	}
+	if !projected {
+		return nil
+	}
+	return p.state.SaveCheckpoint(ctx, checkpoint)
+}
+
+// Status reports the position of the projection and how many events it has yet to project.
+func (p *Projector) Status(ctx context.Context) (ProjectionStatus, error) {
+	position, err := p.state.Checkpoint(ctx)
+	if err != nil {
+		return ProjectionStatus{}, err
+	}
+	lastPosition, err := p.store.LastPosition(ctx)
+	if err != nil {
+		return ProjectionStatus{}, err
+	}
+	status := ProjectionStatus{Name: p.Name(), Position: position, LastPosition: lastPosition}
+	if lastPosition > position {
+		status.Lag = lastPosition - position
+	}
+	return status, nil
+}
+
+// InMemoryProjectionState keeps the changes made since the last checkpoint apart from the values as of the
+// checkpoint, so they can be discarded.
+type InMemoryProjectionState struct {
+	mux        *sync.RWMutex
+	checkpoint uint64
+	values     map[string]json.RawMessage
+	// changes are the values put since the last checkpoint; a nil value marks a deleted key.
+	changes map[string]json.RawMessage
+	// keys are the keys of values and changes, including deleted keys until the next checkpoint.
+	keys *sortedKeys
+}
+
+func NewInMemoryProjectionState() *InMemoryProjectionState {
+	return newInMemoryProjectionState(0, make(map[string]json.RawMessage))
+}
+
+func newInMemoryProjectionState(checkpoint uint64, values map[string]json.RawMessage) *InMemoryProjectionState {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	return &InMemoryProjectionState{
+		mux:        new(sync.RWMutex),
+		checkpoint: checkpoint,
+		values:     values,
+		changes:    make(map[string]json.RawMessage),
+		keys:       newSortedKeys(keys),
+	}
+}
+
+func (i *InMemoryProjectionState) Get(ctx context.Context, key string, v interface{}) (bool, error) {
+	return i.unmarshal(key, v, false)
+}
+
+// unmarshal unmarshals the value of key into v, with the changes since the last checkpoint if pending.
+func (i *InMemoryProjectionState) unmarshal(key string, v interface{}, pending bool) (bool, error) {
+	i.mux.RLock()
+	defer i.mux.RUnlock()
+
+	value, ok := i.values[key]
+	if pending {
+		value, ok = i.get(key)
+	}
+	if !ok {
+		return false, nil
+	}
+	if err := json.Unmarshal(value, v); err != nil {
+		return false, errors.Wrapf(err, "cannot unmarshal projection state %v", key)
+	}
+	return true, nil
+}
+
+// get returns the value of key with the changes since the last checkpoint.
+func (i *InMemoryProjectionState) get(key string) (json.RawMessage, bool) {
+	if value, ok := i.changes[key]; ok {
+		return value, value != nil
+	}
+	value, ok := i.values[key]
+	return value, ok
+}
+
+func (i *InMemoryProjectionState) Put(ctx context.Context, key string, v interface{}) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return errors.Wrapf(err, "cannot marshal projection state %v", key)
+	}
+
+	i.mux.Lock()
+	defer i.mux.Unlock()
+	i.changes[key] = value
+	i.keys.add(key)
+	return nil
+}
+
+func (i *InMemoryProjectionState) Delete(ctx context.Context, key string) error {
+	i.mux.Lock()
+	defer i.mux.Unlock()
+	if _, ok := i.get(key); ok {
+		i.changes[key] = nil
+	}
+	return nil
+}
+
+func (i *InMemoryProjectionState) Keys(ctx context.Context, prefix string) ([]string, error) {
+	return i.keysWithPrefix(prefix, false), nil
+}
+
+// keysWithPrefix returns the keys with the prefix, with the changes since the last checkpoint if pending.
+func (i *InMemoryProjectionState) keysWithPrefix(prefix string, pending bool) []string {
+	i.mux.RLock()
+	defer i.mux.RUnlock()
+
+	var keys []string
+	i.keys.withPrefix(prefix, func(key string) bool {
+		var ok bool
+		if pending {
+			_, ok = i.get(key)
+		} else {
+			_, ok = i.values[key]
+		}
+		if ok {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	return keys
+}
+
+func (i *InMemoryProjectionState) Pending() ProjectionState {
+	return pendingProjectionState{ProjectionState: i, state: i}
+}
+
+// pendingProjectionState is the ProjectionState returned by Pending. It reads the changes of state since the last
+// checkpoint and leaves everything else to the ProjectionState it wraps.
+type pendingProjectionState struct {
+	ProjectionState
+	state *InMemoryProjectionState
+}
+
+func (p pendingProjectionState) Get(ctx context.Context, key string, v interface{}) (bool, error) {
+	return p.state.unmarshal(key, v, true)
+}
+
+func (p pendingProjectionState) Keys(ctx context.Context, prefix string) ([]string, error) {
+	return p.state.keysWithPrefix(prefix, true), nil
+}
+
+func (p pendingProjectionState) Pending() ProjectionState {
+	return p
+}
+
+func (i *InMemoryProjectionState) Checkpoint(ctx context.Context) (uint64, error) {
+	i.mux.RLock()
+	defer i.mux.RUnlock()
+	return i.checkpoint, nil
+}
+
+func (i *InMemoryProjectionState) SaveCheckpoint(ctx context.Context, position uint64) error {
+	i.mux.Lock()
+	defer i.mux.Unlock()
+	i.commit(position)
+	return nil
+}
+
+// commit applies the changes to the values and records position as the checkpoint.
+func (i *InMemoryProjectionState) commit(position uint64) {
+	for key, value := range i.changes {
+		if value == nil {
+			delete(i.values, key)
+			i.keys.remove(key)
+		} else {
+			i.values[key] = value
+		}
+	}
+	i.changes = make(map[string]json.RawMessage)
+	i.checkpoint = position
+}
+
+func (i *InMemoryProjectionState) Discard(ctx context.Context) error {
+	i.mux.Lock()
+	defer i.mux.Unlock()
+	for key := range i.changes {
+		if _, ok := i.values[key]; !ok {
+			i.keys.remove(key)
+		}
+	}
+	i.changes = make(map[string]json.RawMessage)
+	return nil
+}
+
+func (i *InMemoryProjectionState) Clear(ctx context.Context) error {
+	i.mux.Lock()
+	defer i.mux.Unlock()
+	i.clear()
+	return nil
+}
+
+func (i *InMemoryProjectionState) clear() {
+	i.checkpoint = 0
+	i.values = make(map[string]json.RawMessage)
+	i.changes = make(map[string]json.RawMessage)
+	i.keys = newSortedKeys(nil)
+}
+
+// projectionStateCompactionSize is the size of the journal of a LocalFileSystemProjectionState after which it is
+// compacted, as long as the journal is larger than the state.
+const projectionStateCompactionSize = 1 << 20
+
+// LocalFileSystemProjectionState keeps the state of a projection in memory. On SaveCheckpoint the changes since
+// the previous checkpoint are appended to a journal, name.journal, and synced. Once the journal outgrows the state,
+// the state as of the checkpoint is written to name.json and the journal is truncated. Loading the state replays
+// the journal entries after the checkpoint of name.json; an entry cut short by a crash is dropped.
+type LocalFileSystemProjectionState struct {
+	*InMemoryProjectionState
+	filePath    string
+	journal     *os.File
+	journalSize int64
+	stateSize   int64
+}
+
+type projectionStateFile struct {
+	Checkpoint uint64                     `json:"checkpoint"`
+	Values     map[string]json.RawMessage `json:"values"`
+}
+
+// projectionJournalEntry records the changes made to a projection state up to a checkpoint.
+type projectionJournalEntry struct {
+	Checkpoint uint64                     `json:"checkpoint"`
+	Put        map[string]json.RawMessage `json:"put,omitempty"`
+	Delete     []string                   `json:"delete,omitempty"`
+}
+
+// NewLocalFileSystemProjectionState loads the state of the projection name from baseDirectory.
+func NewLocalFileSystemProjectionState(baseDirectory string, name string) (*LocalFileSystemProjectionState, error) {
+	if err := os.MkdirAll(baseDirectory, 0755); err != nil {
+		return nil, errors.Wrap(err, "cannot create projection directory")
+	}
+	l := &LocalFileSystemProjectionState{filePath: path.Join(baseDirectory, name+".json")}
+
+	stateFile := projectionStateFile{Values: make(map[string]json.RawMessage)}
+	data, err := ioutil.ReadFile(l.filePath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrapf(err, "cannot read projection state %v", name)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &stateFile); err != nil {
+			return nil, errors.Wrapf(err, "cannot unmarshal projection state %v", name)
+		}
+		if stateFile.Values == nil {
+			stateFile.Values = make(map[string]json.RawMessage)
+		}
+		l.stateSize = int64(len(data))
+	}
+
+	l.journal, err = os.OpenFile(l.journalPath(), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot open projection journal %v", name)
+	}
+	if err := l.replayJournal(&stateFile); err != nil {
+		l.journal.Close()
+		return nil, errors.Wrapf(err, "cannot replay projection journal %v", name)
+	}
+	l.InMemoryProjectionState = newInMemoryProjectionState(stateFile.Checkpoint, stateFile.Values)
+	return l, nil
+}
+
+// replayJournal applies the complete journal entries after the checkpoint of stateFile to it and truncates the
+// journal after the last complete entry.
+func (l *LocalFileSystemProjectionState) replayJournal(stateFile *projectionStateFile) error {
+	data, err := ioutil.ReadAll(l.journal)
+	if err != nil {
+		return err
+	}
+	var size int64
+	for len(data) > 0 {
+		end := bytes.IndexByte(data, '\n')
+		if end < 0 {
+			break
+		}
+		var entry projectionJournalEntry
+		if err := json.Unmarshal(data[:end], &entry); err != nil {
+			break
+		}
+		if entry.Checkpoint > stateFile.Checkpoint {
+			for key, value := range entry.Put {
+				stateFile.Values[key] = value
+			}
+			for _, key := range entry.Delete {
+				delete(stateFile.Values, key)
+			}
+			stateFile.Checkpoint = entry.Checkpoint
+		}
+		size += int64(end + 1)
+		data = data[end+1:]
+	}
+	l.journalSize = size
+	if err := l.journal.Truncate(size); err != nil {
+		return err
+	}
+	_, err = l.journal.Seek(size, io.SeekStart)
+	return err
+}
+
+// SaveCheckpoint appends the changes since the previous checkpoint to the journal and syncs it before applying
+// them, so a failed SaveCheckpoint leaves the changes pending.
+func (l *LocalFileSystemProjectionState) SaveCheckpoint(ctx context.Context, position uint64) error {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	entry := projectionJournalEntry{Checkpoint: position, Put: make(map[string]json.RawMessage)}
+	for key, value := range l.changes {
+		if value == nil {
+			entry.Delete = append(entry.Delete, key)
+		} else {
+			entry.Put[key] = value
+		}
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return errors.Wrap(err, "cannot marshal projection journal entry")
+	}
+	data = append(data, '\n')
+	if _, err := l.journal.Write(data); err == nil {
+		err = l.journal.Sync()
+	}
+	if err != nil {
+		l.journal.Truncate(l.journalSize)
+		l.journal.Seek(l.journalSize, io.SeekStart)
+		return errors.Wrap(err, "cannot write projection journal")
+	}
+	l.journalSize += int64(len(data))
+	l.commit(position)
+
+	if l.journalSize < projectionStateCompactionSize || l.journalSize < l.stateSize {
+		return nil
+	}
+	return l.compact()
+}
+
+func (l *LocalFileSystemProjectionState) Pending() ProjectionState {
+	return pendingProjectionState{ProjectionState: l, state: l.InMemoryProjectionState}
+}
+
+// compact writes the state as of the checkpoint to the state file and truncates the journal.
+func (l *LocalFileSystemProjectionState) compact() error {
+	data, err := json.Marshal(projectionStateFile{Checkpoint: l.checkpoint, Values: l.values})
+	if err != nil {
+		return errors.Wrap(err, "cannot marshal projection state")
+	}
+	if err := l.writeState(data); err != nil {
+		return errors.Wrap(err, "cannot write projection state")
+	}
+	l.stateSize = int64(len(data))
+	return l.truncateJournal()
+}
+
+func (l *LocalFileSystemProjectionState) Clear(ctx context.Context) error {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	// The journal is truncated first, so a crash before the state file is removed cannot leave journal entries
+	// that are replayed onto an empty state.
+	l.clear()
+	if err := l.truncateJournal(); err != nil {
+		return err
+	}
+	if err := os.Remove(l.filePath); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "cannot remove projection state")
+	}
+	l.stateSize = 0
+	return syncDir(path.Dir(l.filePath))
+}
+
+// Close closes the journal.
+func (l *LocalFileSystemProjectionState) Close() error {
+	return l.journal.Close()
+}
+
+func (l *LocalFileSystemProjectionState) truncateJournal() error {
+	if err := l.journal.Truncate(0); err != nil {
+		return errors.Wrap(err, "cannot truncate projection journal")
+	}
+	if _, err := l.journal.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	l.journalSize = 0
+	return l.journal.Sync()
+}
+
+func (l *LocalFileSystemProjectionState) writeState(data []byte) error {
+	tempFile, err := ioutil.TempFile(path.Dir(l.filePath), tempFilePrefix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+	_, err = tempFile.Write(data)
+	if err == nil {
+		err = tempFile.Sync()
+	}
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tempFile.Name(), l.filePath); err != nil {
+		return err
+	}
+	return syncDir(path.Dir(l.filePath))
+}
+
+func (l *LocalFileSystemProjectionState) journalPath() string {
+	return strings.TrimSuffix(l.filePath, ".json") + ".journal"
+}
@@ -0,0 +1,336 @@
+package blob
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// blobTypeCounts counts the blobs created for each BlobType.
+type blobTypeCounts struct{}
+
+func (blobTypeCounts) Name() string {
+	return "blob-type-counts"
+}
+
+func (blobTypeCounts) Handles() []Event {
+	return []Event{CreatedEvent{}}
+}
+
+func (blobTypeCounts) Project(ctx context.Context, state ProjectionState, event EventWithMetadata) error {
+	key := "count/" + event.Event.(CreatedEvent).BlobType.String()
+	var count int
+	if _, err := state.Get(ctx, key, &count); err != nil {
+		return err
+	}
+	return state.Put(ctx, key, count+1)
+}
+
+func TestProjector(t *testing.T) {
+	dir, err := ioutil.TempDir("", "projections")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := NewInMemoryEventStore()
+	repo := NewAggregateRepository(store)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for _, cmd := range []Command{
+		CreateCommand("1", "text/plain", []byte("1")),
+		CreateCommand("2", "text/plain", []byte("2")),
+		UpdateTagsCommand("2", Tags{"a": "b"}, nil),
+		CreateCommand("3", "application/json", []byte("{}")),
+	} {
+		if _, err := repo.Process(ctx, cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	state, err := NewLocalFileSystemProjectionState(dir, blobTypeCounts{}.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	projector := NewProjector(store, blobTypeCounts{}, state)
+	done := make(chan error)
+	go func() { done <- projector.Run(ctx) }()
+
+	waitForProjection := func() {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			status, err := projector.Status(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status.Lag == 0 {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected the projection to catch up but got %+v", status)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	assertCount := func(state ProjectionState, blobType string, expected int) {
+		var count int
+		if _, err := state.Get(ctx, "count/"+blobType, &count); err != nil {
+			t.Fatal(err)
+		}
+		if count != expected {
+			t.Fatalf("Expected %d blobs of type %v but got %d", expected, blobType, count)
+		}
+	}
+
+	waitForProjection()
+	if _, err := repo.Process(ctx, CreateCommand("4", "text/plain", []byte("4"))); err != nil {
+		t.Fatal(err)
+	}
+	waitForProjection()
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("Expected the projection to stop with the context but got '%v'", err)
+	}
+
+	reopened, err := NewLocalFileSystemProjectionState(dir, blobTypeCounts{}.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertCount(reopened, "text/plain", 3)
+	assertCount(reopened, "application/json", 1)
+
+	ctx = context.Background()
+	if err := NewProjector(store, blobTypeCounts{}, reopened).Rebuild(ctx); err != nil {
+		t.Fatal(err)
+	}
+	assertCount(reopened, "text/plain", 3)
+	if checkpoint, err := reopened.Checkpoint(ctx); err != nil || checkpoint != 5 {
+		t.Fatalf("Expected checkpoint 5 after a rebuild but got %d, '%v'", checkpoint, err)
+	}
+}
+
+// failingProjection records each blob it sees and fails on the blob with ID fail.
+type failingProjection struct{}
+
+func (failingProjection) Name() string {
+	return "failing"
+}
+
+func (failingProjection) Handles() []Event {
+	return nil
+}
+
+func (failingProjection) Project(ctx context.Context, state ProjectionState, event EventWithMetadata) error {
+	if err := state.Put(ctx, "seen/"+event.ID.String(), true); err != nil {
+		return err
+	}
+	if event.ID == "fail" {
+		return errors.New("cannot project")
+	}
+	return nil
+}
+
+func TestProjectorDiscardsChangesOfFailedBatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "projections")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	store := NewInMemoryEventStore()
+	repo := NewAggregateRepository(store)
+	if _, err := repo.Process(ctx, CreateCommand("1", "text/plain", []byte("1"))); err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := NewLocalFileSystemProjectionState(dir, failingProjection{}.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	projector := NewProjector(store, failingProjection{}, state)
+	if err := projector.Rebuild(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, cmd := range []Command{
+		CreateCommand("2", "text/plain", []byte("2")),
+		CreateCommand("fail", "text/plain", []byte("fail")),
+	} {
+		if _, err := repo.Process(ctx, cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	events, err := store.ReadAll(ctx, 2, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := projector.projectEvents(ctx, events); err == nil {
+		t.Fatal("Expected the batch to fail")
+	}
+	if found, err := state.Get(ctx, "seen/2", new(bool)); err != nil || found {
+		t.Fatalf("Expected the changes of the failed batch to be discarded but got %v, '%v'", found, err)
+	}
+	if keys, err := state.Keys(ctx, "seen/"); err != nil || !reflect.DeepEqual(keys, []string{"seen/1"}) {
+		t.Fatalf("Expected only the keys as of the checkpoint but got %v, '%v'", keys, err)
+	}
+
+	// A journal entry cut short by a crash is dropped when the state is loaded.
+	journal, err := os.OpenFile(state.journalPath(), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := journal.WriteString(`{"checkpoint":3,"put":{"seen/2"`); err != nil {
+		t.Fatal(err)
+	}
+	journal.Close()
+	state.Close()
+
+	reopened, err := NewLocalFileSystemProjectionState(dir, failingProjection{}.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if checkpoint, err := reopened.Checkpoint(ctx); err != nil || checkpoint != 1 {
+		t.Fatalf("Expected checkpoint 1 but got %d, '%v'", checkpoint, err)
+	}
+	if keys, err := reopened.Keys(ctx, "seen/"); err != nil || !reflect.DeepEqual(keys, []string{"seen/1"}) {
+		t.Fatalf("Expected the keys as of the checkpoint but got %v, '%v'", keys, err)
+	}
+}
+
+func TestProjectorSkipsFailedEvents(t *testing.T) {
+	ctx := context.Background()
+	store := NewInMemoryEventStore()
+	repo := NewAggregateRepository(store)
+	for _, cmd := range []Command{
+		CreateCommand("1", "text/plain", []byte("1")),
+		CreateCommand("fail", "text/plain", []byte("fail")),
+		CreateCommand("2", "text/plain", []byte("2")),
+	} {
+		if _, err := repo.Process(ctx, cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var skipped []uint64
+	state := NewInMemoryProjectionState()
+	projector := NewProjector(store, failingProjection{}, state, SkipFailedEvents(func(event EventWithMetadata, err error) {
+		skipped = append(skipped, event.Position)
+	}))
+	if err := projector.Rebuild(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(skipped, []uint64{2}) {
+		t.Fatalf("Expected the event at position 2 to be skipped but got %v", skipped)
+	}
+	if keys, err := state.Keys(ctx, "seen/"); err != nil || !reflect.DeepEqual(keys, []string{"seen/1", "seen/2"}) {
+		t.Fatalf("Expected the events around the skipped one to be projected but got %v, '%v'", keys, err)
+	}
+	if checkpoint, err := state.Checkpoint(ctx); err != nil || checkpoint != 3 {
+		t.Fatalf("Expected checkpoint 3 but got %d, '%v'", checkpoint, err)
+	}
+}
+
+func TestProjectionStateOnlyShowsCommittedValues(t *testing.T) {
+	dir, err := ioutil.TempDir("", "projections")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fileSystemState, err := NewLocalFileSystemProjectionState(dir, "pending")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fileSystemState.Close()
+	states := map[string]ProjectionState{
+		"InMemoryProjectionState":        NewInMemoryProjectionState(),
+		"LocalFileSystemProjectionState": fileSystemState,
+	}
+
+	for stateName, state := range states {
+		t.Run(stateName, func(t *testing.T) {
+			ctx := context.Background()
+			assertKeys := func(state ProjectionState, expected []string) {
+				t.Helper()
+				if keys, err := state.Keys(ctx, "key/"); err != nil || !reflect.DeepEqual(keys, expected) {
+					t.Fatalf("Expected keys %v but got %v, '%v'", expected, keys, err)
+				}
+				for _, key := range expected {
+					if found, err := state.Get(ctx, key, new(int)); err != nil || !found {
+						t.Fatalf("Expected to find %v but got %v, '%v'", key, found, err)
+					}
+				}
+			}
+
+			pending := state.Pending()
+			if err := pending.Put(ctx, "key/a", 1); err != nil {
+				t.Fatal(err)
+			}
+			if err := state.SaveCheckpoint(ctx, 1); err != nil {
+				t.Fatal(err)
+			}
+			if err := pending.Put(ctx, "key/b", 2); err != nil {
+				t.Fatal(err)
+			}
+			if err := pending.Delete(ctx, "key/a"); err != nil {
+				t.Fatal(err)
+			}
+
+			assertKeys(state, []string{"key/a"})
+			if found, err := state.Get(ctx, "key/b", new(int)); err != nil || found {
+				t.Fatalf("Expected a pending key not to be found but got %v, '%v'", found, err)
+			}
+			assertKeys(pending, []string{"key/b"})
+			if found, err := pending.Get(ctx, "key/a", new(int)); err != nil || found {
+				t.Fatalf("Expected a pending delete to be seen but got %v, '%v'", found, err)
+			}
+
+			if err := state.Discard(ctx); err != nil {
+				t.Fatal(err)
+			}
+			assertKeys(state, []string{"key/a"})
+			assertKeys(pending, []string{"key/a"})
+		})
+	}
+}
+
+func TestBlobIndexQueryDoesNotSeeDiscardedChanges(t *testing.T) {
+	ctx := context.Background()
+	state := NewInMemoryProjectionState()
+	index := NewBlobIndex(state)
+
+	for _, event := range wrap("1", 1, CreatedEvent{BlobType: "text/plain"}, TagsAddedEvent{"env": "prod"}) {
+		if err := index.Project(ctx, state.Pending(), event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, query := range []BlobQuery{{}, {Tags: []TagFilter{{Key: "env"}}}} {
+		page, err := index.Query(ctx, query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page.Blobs) != 0 {
+			t.Fatalf("Expected no blobs before the checkpoint but got %v", page.Blobs)
+		}
+	}
+
+	if err := state.Discard(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.SaveCheckpoint(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+	page, err := index.Query(ctx, BlobQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Blobs) != 0 {
+		t.Fatalf("Expected the discarded blobs not to be found but got %v", page.Blobs)
+	}
+}
@@ -0,0 +1,246 @@
+package blob
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// EventCodec converts an Event to and from the bytes stored in persistableEvent.MarshaledEvent.
+type EventCodec interface {
+	Marshal(Event) ([]byte, error)
+	Unmarshal([]byte) (Event, error)
+}
+
+type jsonCodec struct {
+	eventType reflect.Type
+}
+
+// JSONCodec returns an EventCodec that stores events as JSON and decodes them into values of the type of prototype.
+func JSONCodec(prototype Event) EventCodec {
+	return jsonCodec{eventType: reflect.TypeOf(prototype)}
+}
+
+func (j jsonCodec) Marshal(event Event) ([]byte, error) {
+	return json.Marshal(event)
+}
+
+func (j jsonCodec) Unmarshal(data []byte) (Event, error) {
+	event := reflect.New(j.eventType)
+	if err := json.Unmarshal(data, event.Interface()); err != nil {
+		return nil, err
+	}
+	return event.Elem().Interface().(Event), nil
+}
+
+// EventType describes how events of one Go type are persisted.
+type EventType struct {
+	// Name identifies the event type in persisted events. It must never change or be reused.
+	Name string
+	// SchemaVersion is the version of the shape of the event written by Codec.
+	SchemaVersion int
+	Codec         EventCodec
+}
+
+// Upcaster transforms the marshaled payload of an event from one schema version to the next.
+type Upcaster func(json.RawMessage) (json.RawMessage, error)
+
+type upcasterKey struct {
+	name        string
+	fromVersion int
+}
+
+// EventRegistry maps Event types to the EventType used to persist them.
+type EventRegistry struct {
+	mux       *sync.RWMutex
+	byName    map[string]EventType
+	byType    map[reflect.Type]EventType
+	upcasters map[upcasterKey]Upcaster
+}
+
+func NewEventRegistry() *EventRegistry {
+	return &EventRegistry{
+		mux:       new(sync.RWMutex),
+		byName:    make(map[string]EventType),
+		byType:    make(map[reflect.Type]EventType),
+		upcasters: make(map[upcasterKey]Upcaster),
+	}
+}
+
+// DefaultEventRegistry is used by the event stores to persist events unless they are given another registry with
+// WithEventRegistry. It knows all events of this package; other packages register their own events with it.
+var DefaultEventRegistry = NewEventRegistry()
+
+func init() {
+	registerEvents(DefaultEventRegistry)
+}
+
+// registerEvents registers the events of this package with registry. Each event type declares the SchemaVersion it
+// is written with. An upcaster is only registered for a version whose payloads have to change to be read by the
+// next one. Adding Payload to CreatedEvent and DataUpdatedEvent did not need a new version, as a payload without
+// it reads as an event that holds its data.
+func registerEvents(registry *EventRegistry) {
+	for _, event := range []struct {
+		name          string
+		schemaVersion int
+		prototype     Event
+	}{
+		{name: "CE", schemaVersion: 1, prototype: CreatedEvent{}},
+		{name: "DUE", schemaVersion: 1, prototype: DataUpdatedEvent{}},
+		{name: "TAE", schemaVersion: 1, prototype: TagsAddedEvent{}},
+		{name: "TUE", schemaVersion: 1, prototype: TagsUpdatedEvent{}},
+		{name: "TDE", schemaVersion: 1, prototype: TagsDeletedEvent{}},
+		{name: "DE", schemaVersion: 1, prototype: DeletedEvent{}},
+		{name: "RE", schemaVersion: 1, prototype: RestoredEvent{}},
+	} {
+		registry.MustRegister(event.prototype, EventType{Name: event.name, SchemaVersion: event.schemaVersion, Codec: JSONCodec(event.prototype)})
+	}
+}
+
+// Register registers eventType for events of the same type as prototype.
+// It returns an error if the type or the name is already registered.
+func (r *EventRegistry) Register(prototype Event, eventType EventType) error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	t := reflect.TypeOf(prototype)
+	if eventType.Name == "" || eventType.Codec == nil {
+		return fmt.Errorf("event type for %v needs a name and a codec", t)
+	}
+	if existing, ok := r.byType[t]; ok {
+		return fmt.Errorf("event %v is already registered as %q", t, existing.Name)
+	}
+	if _, ok := r.byName[eventType.Name]; ok {
+		return fmt.Errorf("event type name %q is already registered", eventType.Name)
+	}
+	r.byType[t] = eventType
+	r.byName[eventType.Name] = eventType
+	return nil
+}
+
+// MustRegister is like Register but panics if the event cannot be registered.
+func (r *EventRegistry) MustRegister(prototype Event, eventType EventType) {
+	if err := r.Register(prototype, eventType); err != nil {
+		panic(err)
+	}
+}
+
+// RegisterUpcaster registers upcaster to transform payloads of the event type name from fromVersion to fromVersion+1.
+// Unmarshal chains upcasters to bring payloads of any older version to the registered SchemaVersion.
+func (r *EventRegistry) RegisterUpcaster(name string, fromVersion int, upcaster Upcaster) error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	key := upcasterKey{name, fromVersion}
+	if _, ok := r.upcasters[key]; ok {
+		return fmt.Errorf("upcaster for %q from version %d is already registered", name, fromVersion)
+	}
+	r.upcasters[key] = upcaster
+	return nil
+}
+
+// MustRegisterUpcaster is like RegisterUpcaster but panics if the upcaster cannot be registered.
+func (r *EventRegistry) MustRegisterUpcaster(name string, fromVersion int, upcaster Upcaster) {
+	if err := r.RegisterUpcaster(name, fromVersion, upcaster); err != nil {
+		panic(err)
+	}
+}
+
+// Lookup returns the EventType registered for the type of event.
+func (r *EventRegistry) Lookup(event Event) (EventType, error) {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	eventType, ok := r.byType[reflect.TypeOf(event)]
+	if !ok {
+		return EventType{}, fmt.Errorf("event %T is not registered", event)
+	}
+	return eventType, nil
+}
+
+// LookupName returns the EventType registered with name.
+func (r *EventRegistry) LookupName(name string) (EventType, error) {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	eventType, ok := r.byName[name]
+	if !ok {
+		return EventType{}, fmt.Errorf("unknown event type %q", name)
+	}
+	return eventType, nil
+}
+
+// Marshal converts event to the persisted form used by the event stores.
+func (r *EventRegistry) Marshal(event EventWithMetadata) ([]byte, error) {
+	eventType, err := r.Lookup(event.Event)
+	if err != nil {
+		return nil, err
+	}
+	marshaledEvent, err := eventType.Codec.Marshal(event.Event)
+	if err != nil {
+		return nil, fmt.Errorf("cannot marshal %q event: %v", eventType.Name, err)
+	}
+	return json.Marshal(persistableEvent{
+		ID:             event.ID,
+		Sequence:       event.Sequence,
+		Position:       event.Position,
+		Metadata:       event.Metadata,
+		EventType:      eventType.Name,
+		SchemaVersion:  eventType.SchemaVersion,
+		MarshaledEvent: marshaledEvent,
+	})
+}
+
+// Unmarshal converts data written by Marshal back to an event.
+func (r *EventRegistry) Unmarshal(data []byte) (EventWithMetadata, error) {
+	var pe persistableEvent
+	if err := json.Unmarshal(data, &pe); err != nil {
+		return EventWithMetadata{}, err
+	}
+	eventType, err := r.LookupName(pe.EventType)
+	if err != nil {
+		return EventWithMetadata{}, fmt.Errorf("cannot unmarshal event %d of id %v: %v", pe.Sequence, pe.ID, err)
+	}
+	marshaledEvent, err := r.upcast(eventType, pe.schemaVersion(), pe.MarshaledEvent)
+	if err != nil {
+		return EventWithMetadata{}, fmt.Errorf("cannot upcast %q event %d of id %v: %v", pe.EventType, pe.Sequence, pe.ID, err)
+	}
+	event, err := eventType.Codec.Unmarshal(marshaledEvent)
+	if err != nil {
+		return EventWithMetadata{}, fmt.Errorf("cannot unmarshal %q event %d of id %v: %v", pe.EventType, pe.Sequence, pe.ID, err)
+	}
+	return EventWithMetadata{ID: pe.ID, Sequence: pe.Sequence, Position: pe.Position, Metadata: pe.Metadata, Event: event}, nil
+}
+
+func (r *EventRegistry) upcast(eventType EventType, version int, marshaledEvent json.RawMessage) (json.RawMessage, error) {
+	if version > eventType.SchemaVersion {
+		return nil, fmt.Errorf("schema version %d is newer than the supported version %d", version, eventType.SchemaVersion)
+	}
+	for ; version < eventType.SchemaVersion; version++ {
+		r.mux.RLock()
+		upcaster, ok := r.upcasters[upcasterKey{eventType.Name, version}]
+		r.mux.RUnlock()
+		if !ok {
+			return nil, fmt.Errorf("no upcaster from schema version %d", version)
+		}
+		var err error
+		if marshaledEvent, err = upcaster(marshaledEvent); err != nil {
+			return nil, fmt.Errorf("upcaster from schema version %d failed: %v", version, err)
+		}
+	}
+	return marshaledEvent, nil
+}
+
+// IsLatest reports whether data written by Marshal holds an event in its registered SchemaVersion.
+func (r *EventRegistry) IsLatest(data []byte) (bool, error) {
+	var pe persistableEvent
+	if err := json.Unmarshal(data, &pe); err != nil {
+		return false, err
+	}
+	eventType, err := r.LookupName(pe.EventType)
+	if err != nil {
+		return false, err
+	}
+	return pe.schemaVersion() == eventType.SchemaVersion, nil
+}
@@ -0,0 +1,124 @@
+package blob
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type renamedEvent struct {
+	Name string
+}
+
+func (r renamedEvent) Apply(b Blob) Blob {
+	b.BlobType = BlobType(r.Name)
+	return b
+}
+
+func TestEventRegistry(t *testing.T) {
+	registry := NewEventRegistry()
+	if err := registry.Register(renamedEvent{}, EventType{Name: "renamed", SchemaVersion: 1, Codec: JSONCodec(renamedEvent{})}); err != nil {
+		t.Fatal(err)
+	}
+	if err := registry.Register(renamedEvent{}, EventType{Name: "other", SchemaVersion: 1, Codec: JSONCodec(renamedEvent{})}); err == nil {
+		t.Fatal("Expected registering the same event twice to fail")
+	}
+
+	event := EventWithMetadata{ID: "1", Sequence: 1, Event: renamedEvent{Name: "text/plain"}}
+	data, err := registry.Marshal(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unmarshaled, err := registry.Unmarshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(event, unmarshaled) {
+		t.Fatalf("Expected %#v but got %#v", event, unmarshaled)
+	}
+
+	if _, err := DefaultEventRegistry.Unmarshal(data); err == nil || !strings.Contains(err.Error(), `unknown event type "renamed"`) {
+		t.Fatalf("Expected an unknown event type error but got '%v'", err)
+	}
+	if _, err := DefaultEventRegistry.Marshal(event); err == nil {
+		t.Fatal("Expected marshaling an unregistered event to fail")
+	}
+}
+
+// versionedEvent stored its name as Title in schema version 1.
+type versionedEvent struct {
+	Name string
+}
+
+func (v versionedEvent) Apply(b Blob) Blob {
+	return b
+}
+
+// newVersionedEventRegistry returns a registry of the events of this package and of version 2 of versionedEvent.
+func newVersionedEventRegistry() *EventRegistry {
+	registry := NewEventRegistry()
+	registerEvents(registry)
+	registry.MustRegister(versionedEvent{}, EventType{Name: "test.versioned", SchemaVersion: 2, Codec: JSONCodec(versionedEvent{})})
+	registry.MustRegisterUpcaster("test.versioned", 1, renameTitleToName)
+	return registry
+}
+
+func renameTitleToName(data json.RawMessage) (json.RawMessage, error) {
+	var v1 struct{ Title string }
+	if err := json.Unmarshal(data, &v1); err != nil {
+		return nil, err
+	}
+	return json.Marshal(versionedEvent{Name: v1.Title})
+}
+
+func TestEventRegistryUpcasts(t *testing.T) {
+	registry := NewEventRegistry()
+	registry.MustRegister(versionedEvent{}, EventType{Name: "test.versioned", SchemaVersion: 3, Codec: JSONCodec(versionedEvent{})})
+	registry.MustRegisterUpcaster("test.versioned", 1, renameTitleToName)
+
+	v1 := []byte(`{"id":"1","sequence":1,"eventType":"test.versioned","marshaledEvent":{"Title":"hello"}}`)
+	if _, err := registry.Unmarshal(v1); err == nil || !strings.Contains(err.Error(), "no upcaster from schema version 2") {
+		t.Fatalf("Expected a missing upcaster error but got '%v'", err)
+	}
+
+	registry.MustRegisterUpcaster("test.versioned", 2, func(data json.RawMessage) (json.RawMessage, error) {
+		var v2 versionedEvent
+		if err := json.Unmarshal(data, &v2); err != nil {
+			return nil, err
+		}
+		v2.Name = strings.ToUpper(v2.Name)
+		return json.Marshal(v2)
+	})
+	event, err := registry.Unmarshal(v1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := (versionedEvent{Name: "HELLO"}); event.Event != expected {
+		t.Fatalf("Expected %#v but got %#v", expected, event.Event)
+	}
+
+	latest, err := registry.IsLatest(v1)
+	if err != nil || latest {
+		t.Fatalf("Expected version 1 not to be the latest but got %v, '%v'", latest, err)
+	}
+
+	v4 := []byte(`{"id":"1","sequence":1,"eventType":"test.versioned","schemaVersion":4,"marshaledEvent":{}}`)
+	if _, err := registry.Unmarshal(v4); err == nil {
+		t.Fatal("Expected an event from a newer schema version to fail")
+	}
+}
+
+func TestDefaultEventRegistryReadsEventsWithoutPayload(t *testing.T) {
+	data := []byte(`{"id":"1","sequence":1,"eventType":"CE","marshaledEvent":{"BlobType":"text/plain","Data":"aGVsbG8="}}`)
+	event, err := DefaultEventRegistry.Unmarshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := (CreatedEvent{BlobType: "text/plain", Data: []byte("hello")}); !reflect.DeepEqual(event.Event, expected) {
+		t.Fatalf("Expected %#v but got %#v", expected, event.Event)
+	}
+	if latest, err := DefaultEventRegistry.IsLatest(data); err != nil || !latest {
+		t.Fatalf("Expected an event without a schema version to be the latest but got %v, '%v'", latest, err)
+	}
+}
@@ -0,0 +1,72 @@
+package blob
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy controls how AggregateRepository.Process retries a command whose events conflict with
+// events persisted concurrently for the same aggregate.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of times a command is processed, including the first attempt.
+	MaxAttempts int
+	// Backoff is the delay before the first retry. It doubles on every following retry up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Jitter is the fraction, between 0 and 1, of each delay that is randomized.
+	Jitter float64
+}
+
+// DefaultRetryPolicy is used by an AggregateRepository unless WithRetryPolicy is given.
+var DefaultRetryPolicy = RetryPolicy{MaxAttempts: 5, Backoff: 10 * time.Millisecond, MaxBackoff: 500 * time.Millisecond, Jitter: 0.5}
+
+// NoRetryPolicy processes a command only once.
+var NoRetryPolicy = RetryPolicy{MaxAttempts: 1}
+
+// delay returns how long to wait after the given failed attempt, starting with 1.
+func (rp RetryPolicy) delay(attempt int) time.Duration {
+	delay := rp.Backoff
+	for i := 1; i < attempt && (rp.MaxBackoff == 0 || delay < rp.MaxBackoff); i++ {
+		delay *= 2
+	}
+	if rp.MaxBackoff != 0 && delay > rp.MaxBackoff {
+		delay = rp.MaxBackoff
+	}
+	if rp.Jitter > 0 && delay > 0 {
+		jitter := time.Duration(rp.Jitter * float64(delay))
+		delay = delay - jitter + time.Duration(rand.Int63n(int64(jitter)+1))
+	}
+	return delay
+}
+
+// wait sleeps before the next attempt. It returns false without sleeping if ctx would expire before the
+// next attempt could start, or if ctx is done while sleeping.
+func (rp RetryPolicy) wait(ctx context.Context, attempt int) bool {
+	delay := rp.delay(attempt)
+	if deadline, ok := ctx.Deadline(); ok && time.Now().Add(delay).After(deadline) {
+		return false
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+type retriesExhaustedError struct {
+	attempts int
+	lastErr  error
+}
+
+func (retriesExhaustedError) IsRetriesExhausted() bool {
+	return true
+}
+
+func (r retriesExhaustedError) Error() string {
+	return fmt.Sprintf("gave up after %d attempts: %v", r.attempts, r.lastErr)
+}
@@ -0,0 +1,407 @@
+package blob
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"mime"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// maxSearchDocumentSize is how many bytes of the data of a blob are indexed.
+	maxSearchDocumentSize = 1 << 20
+	defaultSearchLimit    = 20
+	maxSearchLimit        = 100
+
+	searchDocumentKeyPrefix = "doc/"
+	searchTermKeyPrefix     = "term/"
+	searchStatsKey          = "stats"
+)
+
+// SearchResult is a blob matching a search query. Results with a higher Score match better.
+type SearchResult struct {
+	ID       `json:"id"`
+	BlobType `json:"blobType"`
+	Score    float64 `json:"score"`
+}
+
+// SearchIndex is a Projection that keeps an inverted index of the data of blobs whose BlobType is text/* or
+// application/json. Deleted blobs are removed from the index and added again when they are restored.
+type SearchIndex struct {
+	mux      *sync.RWMutex
+	state    ProjectionState
+	payloads PayloadStore
+}
+
+// searchDocument is the indexed data of a blob. Terms maps each term to its positions in the data.
+type searchDocument struct {
+	BlobType `json:"blobType"`
+	Deleted  bool             `json:"deleted,omitempty"`
+	Terms    map[string][]int `json:"terms"`
+}
+
+type searchStats struct {
+	Documents int `json:"documents"`
+}
+
+// NewSearchIndex returns a SearchIndex kept in state. It reads the data of events that refer to a payload from
+// payloads, which may be nil if events hold their data.
+func NewSearchIndex(state ProjectionState, payloads PayloadStore) *SearchIndex {
+	return &SearchIndex{mux: new(sync.RWMutex), state: state, payloads: payloads}
+}
+
+func (si *SearchIndex) Name() string {
+	return "search"
+}
+
+func (si *SearchIndex) Handles() []Event {
+	return []Event{CreatedEvent{}, DataUpdatedEvent{}, DeletedEvent{}, RestoredEvent{}}
+}
+
+func (si *SearchIndex) Project(ctx context.Context, state ProjectionState, event EventWithMetadata) error {
+	si.mux.Lock()
+	defer si.mux.Unlock()
+
+	var doc searchDocument
+	found, err := state.Get(ctx, searchDocumentKeyPrefix+event.ID.String(), &doc)
+	if err != nil {
+		return err
+	}
+
+	switch e := event.Event.(type) {
+	case CreatedEvent:
+		if !isSearchable(e.BlobType) {
+			return nil
+		}
+		if found && !doc.Deleted {
+			if err := si.removePostings(ctx, state, event.ID, doc); err != nil {
+				return err
+			}
+		}
+		terms, err := si.terms(ctx, e.Data, e.Payload)
+		if err != nil {
+			return errors.Wrapf(err, "cannot index data for id %v", event.ID)
+		}
+		if !found || doc.Deleted {
+			if err := addSearchDocuments(ctx, state, 1); err != nil {
+				return err
+			}
+		}
+		doc = searchDocument{BlobType: e.BlobType, Terms: terms}
+		if err := si.addPostings(ctx, state, event.ID, doc); err != nil {
+			return err
+		}
+	case DataUpdatedEvent:
+		if !found {
+			return nil
+		}
+		if !doc.Deleted {
+			if err := si.removePostings(ctx, state, event.ID, doc); err != nil {
+				return err
+			}
+		}
+		if doc.Terms, err = si.terms(ctx, e.Data, e.Payload); err != nil {
+			return errors.Wrapf(err, "cannot index data for id %v", event.ID)
+		}
+		if !doc.Deleted {
+			if err := si.addPostings(ctx, state, event.ID, doc); err != nil {
+				return err
+			}
+		}
+	case DeletedEvent:
+		if !found || doc.Deleted {
+			return nil
+		}
+		if err := si.removePostings(ctx, state, event.ID, doc); err != nil {
+			return err
+		}
+		if err := addSearchDocuments(ctx, state, -1); err != nil {
+			return err
+		}
+		doc.Deleted = true
+	case RestoredEvent:
+		if !found || !doc.Deleted {
+			return nil
+		}
+		if err := si.addPostings(ctx, state, event.ID, doc); err != nil {
+			return err
+		}
+		if err := addSearchDocuments(ctx, state, 1); err != nil {
+			return err
+		}
+		doc.Deleted = false
+	default:
+		return nil
+	}
+	return state.Put(ctx, searchDocumentKeyPrefix+event.ID.String(), doc)
+}
+
+// terms reads the data, either given or in the payload, and returns the positions of its terms.
+func (si *SearchIndex) terms(ctx context.Context, data []byte, payload *PayloadRef) (map[string][]int, error) {
+	var r io.Reader = bytes.NewReader(data)
+	if payload != nil {
+		if si.payloads == nil {
+			return nil, fmt.Errorf("cannot read payload %v without a payload store", payload.Digest)
+		}
+		rc, err := si.payloads.Open(ctx, *payload)
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		r = rc
+	}
+	text, err := ioutil.ReadAll(io.LimitReader(r, maxSearchDocumentSize))
+	if err != nil {
+		return nil, err
+	}
+
+	terms := make(map[string][]int)
+	for position, term := range tokenize(string(text)) {
+		terms[term] = append(terms[term], position)
+	}
+	return terms, nil
+}
+
+// addPostings records for each term of the document how often it occurs in the blob with the ID under
+// term/<term>/<id>, so indexing a blob only changes the keys of its own terms.
+func (si *SearchIndex) addPostings(ctx context.Context, state ProjectionState, id ID, doc searchDocument) error {
+	for term, positions := range doc.Terms {
+		if err := state.Put(ctx, searchPostingKey(term, id), len(positions)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (si *SearchIndex) removePostings(ctx context.Context, state ProjectionState, id ID, doc searchDocument) error {
+	for term := range doc.Terms {
+		if err := state.Delete(ctx, searchPostingKey(term, id)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getPostings returns the number of occurrences of the terms with the prefix, which is a term followed by a slash
+// to find a single term, by the ID of the blobs they occur in.
+func getPostings(ctx context.Context, state ProjectionState, prefix string) (map[ID]int, error) {
+	keys, err := state.Keys(ctx, searchTermKeyPrefix+prefix)
+	if err != nil {
+		return nil, err
+	}
+	postings := make(map[ID]int)
+	for _, key := range keys {
+		var frequency int
+		if _, err := state.Get(ctx, key, &frequency); err != nil {
+			return nil, err
+		}
+		// Terms have no slashes so the ID follows the first one after the term key prefix.
+		rest := strings.TrimPrefix(key, searchTermKeyPrefix)
+		postings[ID(rest[strings.IndexByte(rest, '/')+1:])] += frequency
+	}
+	return postings, nil
+}
+
+func searchPostingKey(term string, id ID) string {
+	return searchTermKeyPrefix + term + "/" + id.String()
+}
+
+func addSearchDocuments(ctx context.Context, state ProjectionState, n int) error {
+	var stats searchStats
+	if _, err := state.Get(ctx, searchStatsKey, &stats); err != nil {
+		return err
+	}
+	stats.Documents += n
+	return state.Put(ctx, searchStatsKey, stats)
+}
+
+// searchClause matches blobs with all terms next to each other in order. If prefix is set the only term is a
+// prefix of the terms to match.
+type searchClause struct {
+	terms  []string
+	prefix bool
+}
+
+// Search returns up to limit blobs that match every term, "quoted phrase" and prefix* of the query ordered by
+// score. A clause scores higher the more often it occurs in a blob and the fewer blobs it occurs in.
+func (si *SearchIndex) Search(ctx context.Context, query string, limit int) ([]SearchResult, error) {
+	if limit == 0 {
+		limit = defaultSearchLimit
+	}
+	if limit < 0 || limit > maxSearchLimit {
+		return nil, commandError(fmt.Sprintf("limit should be between 1 and %d", maxSearchLimit))
+	}
+	clauses, err := parseSearchQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	si.mux.RLock()
+	defer si.mux.RUnlock()
+
+	var stats searchStats
+	if _, err := si.state.Get(ctx, searchStatsKey, &stats); err != nil {
+		return nil, err
+	}
+
+	var scores map[ID]float64
+	docs := make(map[ID]searchDocument)
+	for _, clause := range clauses {
+		matches, err := si.match(ctx, clause, docs)
+		if err != nil {
+			return nil, err
+		}
+		idf := math.Log(1 + float64(stats.Documents)/float64(len(matches)+1))
+		clauseScores := make(map[ID]float64)
+		for id, frequency := range matches {
+			if _, ok := scores[id]; scores != nil && !ok {
+				continue
+			}
+			clauseScores[id] = scores[id] + (1+math.Log(float64(frequency)))*idf
+		}
+		scores = clauseScores
+	}
+
+	results := make([]SearchResult, 0, len(scores))
+	for id, score := range scores {
+		doc, err := si.document(ctx, id, docs)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, SearchResult{ID: id, BlobType: doc.BlobType, Score: score})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].ID < results[j].ID
+	})
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
+
+// match returns how often the clause occurs by the ID of the blobs it occurs in. Documents loaded to match
+// phrases are cached in docs.
+func (si *SearchIndex) match(ctx context.Context, clause searchClause, docs map[ID]searchDocument) (map[ID]int, error) {
+	if clause.prefix {
+		return getPostings(ctx, si.state, clause.terms[0])
+	}
+
+	matches, err := getPostings(ctx, si.state, clause.terms[0]+"/")
+	if err != nil || len(clause.terms) == 1 {
+		return matches, err
+	}
+	for _, term := range clause.terms[1:] {
+		for id := range matches {
+			found, err := si.state.Get(ctx, searchPostingKey(term, id), new(int))
+			if err != nil {
+				return nil, err
+			}
+			if !found {
+				delete(matches, id)
+			}
+		}
+	}
+	for id := range matches {
+		doc, err := si.document(ctx, id, docs)
+		if err != nil {
+			return nil, err
+		}
+		if matches[id] = phraseFrequency(doc, clause.terms); matches[id] == 0 {
+			delete(matches, id)
+		}
+	}
+	return matches, nil
+}
+
+func (si *SearchIndex) document(ctx context.Context, id ID, docs map[ID]searchDocument) (searchDocument, error) {
+	if doc, ok := docs[id]; ok {
+		return doc, nil
+	}
+	var doc searchDocument
+	if _, err := si.state.Get(ctx, searchDocumentKeyPrefix+id.String(), &doc); err != nil {
+		return searchDocument{}, err
+	}
+	docs[id] = doc
+	return doc, nil
+}
+
+// phraseFrequency returns how often the terms occur next to each other in order in the document.
+func phraseFrequency(doc searchDocument, terms []string) int {
+	next := make([]map[int]bool, len(terms))
+	for i, term := range terms {
+		next[i] = make(map[int]bool)
+		for _, position := range doc.Terms[term] {
+			next[i][position] = true
+		}
+	}
+	var frequency int
+	for _, position := range doc.Terms[terms[0]] {
+		i := 1
+		for i < len(terms) && next[i][position+i] {
+			i++
+		}
+		if i == len(terms) {
+			frequency++
+		}
+	}
+	return frequency
+}
+
+// parseSearchQuery splits the query into clauses of a "quoted phrase", a prefix* or otherwise a term. A term that
+// tokenizes into several terms, such as e-mail, is matched as a phrase.
+func parseSearchQuery(query string) ([]searchClause, error) {
+	var clauses []searchClause
+	for rest := strings.TrimSpace(query); rest != ""; rest = strings.TrimSpace(rest) {
+		var text string
+		phrase := rest[0] == '"'
+		if phrase {
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				return nil, commandError("search query has an unterminated phrase")
+			}
+			text, rest = rest[1:end+1], rest[end+2:]
+		} else if end := strings.IndexFunc(rest, unicode.IsSpace); end >= 0 {
+			text, rest = rest[:end], rest[end:]
+		} else {
+			text, rest = rest, ""
+		}
+
+		terms := tokenize(text)
+		if len(terms) == 0 {
+			continue
+		}
+		prefix := !phrase && len(terms) == 1 && strings.HasSuffix(text, "*")
+		clauses = append(clauses, searchClause{terms: terms, prefix: prefix})
+	}
+	if len(clauses) == 0 {
+		return nil, commandError("search query should have at least one term")
+	}
+	return clauses, nil
+}
+
+// tokenize splits text into lower case terms of letters and digits.
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+func isSearchable(blobType BlobType) bool {
+	mediaType, _, err := mime.ParseMediaType(blobType.String())
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(mediaType, "text/") || mediaType == "application/json"
+}
@@ -0,0 +1,96 @@
+package blob
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/venkssa/eventsourcing/internal/platform"
+)
+
+func TestSearchIndex(t *testing.T) {
+	store := NewInMemoryEventStore()
+	payloads := NewInMemoryPayloadStore()
+	repo := NewAggregateRepository(store, WithPayloads(payloads))
+	ctx := context.Background()
+
+	for _, cmd := range []Command{
+		CreateCommand("a", "text/plain", []byte("The quick brown fox jumps over the lazy dog")),
+		CreateCommand("b", "application/json", []byte(`{"animal": "fox", "colour": "brown", "note": "quick fox, quick"}`)),
+		CreateCommand("c", "text/markdown; charset=utf-8", []byte("# Searching\nA brown bear")),
+		CreateCommand("d", "application/octet-stream", []byte("brown fox")),
+		CreateCommand("e", "text/plain", []byte("foxes everywhere")),
+		UpdateCommand("e", []byte("no animals here"), false),
+		DeleteCommand("c"),
+	} {
+		if _, err := repo.Process(ctx, cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	index := NewSearchIndex(NewInMemoryProjectionState(), payloads)
+	projector := NewProjector(store, index, index.state)
+	if err := projector.Rebuild(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		Query       string
+		ExpectedIDs []ID
+	}{
+		"term ordered by score":               {"quick", []ID{"b", "a"}},
+		"terms are case insensitive":          {"FOX", []ID{"b", "a"}},
+		"every term has to match":             {"brown lazy", []ID{"a"}},
+		"phrase":                              {`"brown fox"`, []ID{"a"}},
+		"phrase in json":                      {`"quick fox"`, []ID{"b"}},
+		"prefix":                              {"sea*", nil},
+		"prefix across terms":                 {"qui* d*", []ID{"a"}},
+		"updated data is indexed":             {"animals", []ID{"e"}},
+		"replaced data is removed":            {"foxes", nil},
+		"deleted blobs are removed":           {"bear", nil},
+		"blobs that are not text are skipped": {"brown", []ID{"a", "b"}},
+	}
+	for testName, data := range tests {
+		t.Run(testName, func(t *testing.T) {
+			results, err := index.Search(ctx, data.Query, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ids []ID
+			for _, result := range results {
+				ids = append(ids, result.ID)
+			}
+			if !reflect.DeepEqual(ids, data.ExpectedIDs) {
+				t.Fatalf("Expected %v but got %v", data.ExpectedIDs, ids)
+			}
+		})
+	}
+
+	if _, err := repo.Process(ctx, RestoreCommand("c")); err != nil {
+		t.Fatal(err)
+	}
+	if err := projector.projectEvents(ctx, mustReadAll(t, store)); err != nil {
+		t.Fatal(err)
+	}
+	results, err := index.Search(ctx, "bear", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].ID != "c" || results[0].BlobType != "text/markdown; charset=utf-8" {
+		t.Fatalf("Expected the restored blob to be found but got %v", results)
+	}
+
+	for _, query := range []string{"", "  ", `"unterminated`, "*"} {
+		if _, err := index.Search(ctx, query, 0); !platform.CommandError(err) {
+			t.Fatalf("Expected a command error for query %q but got '%v'", query, err)
+		}
+	}
+}
+
+func mustReadAll(t *testing.T, store EventStore) EventWithMetadataSlice {
+	events, err := store.ReadAll(context.Background(), 1, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return events
+}
@@ -0,0 +1,515 @@
+package blob
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	segmentFileSuffix = ".log"
+	indexFileName     = "index"
+	recordHeaderSize  = 8
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// SegmentedLogEventStore appends events to segment files in a single directory.
+//
+// Every event is a record made of a 4 byte length, a 4 byte CRC-32C checksum of the payload and the payload.
+// Once the active segment grows past maxSegmentSize the next Persist starts a new segment, so the events of
+// a single Persist always live in the same segment. An index file of JSON lines maps every ID to the segment
+// and offset of its records so Find seeks to the records instead of scanning the segments. Index entries are in
+// the order the records were appended, which gives the position of each event.
+type SegmentedLogEventStore struct {
+	*notifier
+	mux            *sync.Mutex
+	directory      string
+	maxSegmentSize int64
+	registry       *EventRegistry
+
+	index     map[ID][]recordLocation
+	indexFile *os.File
+	indexSize int64
+	// log holds the location of every record in the order they were appended; a record is at position index+1.
+	log []recordLocation
+
+	segments map[uint64]*os.File
+	// sizes holds the size of every segment, so reading a record does not have to stat its segment.
+	sizes         map[uint64]int64
+	activeSegment uint64
+}
+
+type recordLocation struct {
+	Sequence uint64 `json:"sequence"`
+	Segment  uint64 `json:"segment"`
+	Offset   int64  `json:"offset"`
+	// Batch is the sequence of the first event persisted along with this one, or 0 if the record was indexed
+	// before batches were recorded.
+	Batch uint64 `json:"batch,omitempty"`
+}
+
+type indexEntry struct {
+	ID `json:"id"`
+	recordLocation
+}
+
+// NewSegmentedLogEventStore opens the store in directory, creating it if needed. Records written after the last
+// index entry are indexed and a partially written record at the end of the last segment is discarded. Any other
+// record that cannot be read is an error.
+func NewSegmentedLogEventStore(directory string, maxSegmentSize int64, opts ...EventStoreOption) (*SegmentedLogEventStore, error) {
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return nil, errors.Wrap(err, "cannot create directory for segmented log")
+	}
+	s := &SegmentedLogEventStore{
+		notifier:       newNotifier(),
+		mux:            new(sync.Mutex),
+		directory:      directory,
+		maxSegmentSize: maxSegmentSize,
+		registry:       newEventStoreOptions(opts).registry,
+		index:          make(map[ID][]recordLocation),
+		segments:       make(map[uint64]*os.File),
+		sizes:          make(map[uint64]int64),
+	}
+	if err := s.open(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *SegmentedLogEventStore) open() error {
+	segments, err := s.listSegments()
+	if err != nil {
+		return errors.Wrap(err, "cannot list segments")
+	}
+	if len(segments) == 0 {
+		segments = []uint64{0}
+	}
+	for _, segment := range segments {
+		f, err := os.OpenFile(s.segmentPath(segment), os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return errors.Wrapf(err, "cannot open segment %d", segment)
+		}
+		s.segments[segment] = f
+		info, err := f.Stat()
+		if err != nil {
+			return errors.Wrapf(err, "cannot stat segment %d", segment)
+		}
+		s.sizes[segment] = info.Size()
+	}
+	s.activeSegment = segments[len(segments)-1]
+
+	lastIndexed, err := s.loadIndex()
+	if err != nil {
+		return err
+	}
+	return s.recover(lastIndexed)
+}
+
+// loadIndex reads the index file into memory and returns the location of the last indexed record.
+// A partially written last line is removed from the index file.
+func (s *SegmentedLogEventStore) loadIndex() (*recordLocation, error) {
+	f, err := os.OpenFile(path.Join(s.directory, indexFileName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot open index")
+	}
+	s.indexFile = f
+
+	var lastIndexed *recordLocation
+	var validSize int64
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot read index")
+		}
+		var entry indexEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return nil, errors.Wrapf(err, "corrupt index entry at offset %d", validSize)
+		}
+		s.index[entry.ID] = append(s.index[entry.ID], entry.recordLocation)
+		s.log = append(s.log, entry.recordLocation)
+		location := entry.recordLocation
+		lastIndexed = &location
+		validSize += int64(len(line))
+	}
+
+	if err := f.Truncate(validSize); err != nil {
+		return nil, errors.Wrap(err, "cannot truncate index")
+	}
+	s.indexSize = validSize
+	return lastIndexed, nil
+}
+
+// recover indexes the records written after lastIndexed and truncates the active segment before its last record
+// if that was only partially written. Records are only left unindexed by the last Persist, so the unindexed records
+// of an ID are indexed as one batch. A record that cannot be read anywhere else is corruption and an error.
+func (s *SegmentedLogEventStore) recover(lastIndexed *recordLocation) error {
+	segment, offset := uint64(0), int64(0)
+	if lastIndexed != nil {
+		_, size, err := s.readRecord(lastIndexed.Segment, lastIndexed.Offset)
+		if err != nil {
+			return errors.Wrapf(err, "cannot read last indexed record at %d:%d", lastIndexed.Segment, lastIndexed.Offset)
+		}
+		segment, offset = lastIndexed.Segment, lastIndexed.Offset+size
+	}
+
+	var unindexed []indexEntry
+	batches := make(map[ID]uint64)
+	for ; segment <= s.activeSegment; segment, offset = segment+1, 0 {
+		if _, ok := s.segments[segment]; !ok {
+			continue
+		}
+		for offset < s.sizes[segment] {
+			data, err := s.readRecordData(segment, offset)
+			if err != nil {
+				if segment != s.activeSegment || !s.isLastRecord(segment, offset) {
+					return errors.Wrapf(err, "corrupt record at %d:%d", segment, offset)
+				}
+				if err := s.segments[segment].Truncate(offset); err != nil {
+					return errors.Wrap(err, "cannot truncate partially written record")
+				}
+				s.sizes[segment] = offset
+				break
+			}
+			event, err := s.registry.Unmarshal(data)
+			if err != nil {
+				return errors.Wrapf(err, "cannot unmarshal record at %d:%d", segment, offset)
+			}
+			if _, ok := batches[event.ID]; !ok {
+				batches[event.ID] = event.Sequence
+			}
+			size := int64(recordHeaderSize + len(data))
+			unindexed = append(unindexed, indexEntry{event.ID, recordLocation{event.Sequence, segment, offset, batches[event.ID]}})
+			offset += size
+		}
+	}
+	return s.appendIndex(unindexed)
+}
+
+// isLastRecord reports whether the record at offset in segment reaches the end of the segment, so no complete
+// record follows it. The header of a record that is cut short cannot be trusted and is taken to be the last one.
+func (s *SegmentedLogEventStore) isLastRecord(segment uint64, offset int64) bool {
+	size := s.sizes[segment]
+	header := make([]byte, recordHeaderSize)
+	if offset+recordHeaderSize > size {
+		return true
+	}
+	if _, err := s.segments[segment].ReadAt(header, offset); err != nil {
+		return true
+	}
+	return offset+recordHeaderSize+int64(binary.BigEndian.Uint32(header[:4])) >= size
+}
+
+func (s *SegmentedLogEventStore) listSegments() ([]uint64, error) {
+	files, err := ioutil.ReadDir(s.directory)
+	if err != nil {
+		return nil, err
+	}
+	var segments []uint64
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), segmentFileSuffix) {
+			continue
+		}
+		segment, err := strconv.ParseUint(strings.TrimSuffix(file.Name(), segmentFileSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, segment)
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	return segments, nil
+}
+
+func (s *SegmentedLogEventStore) segmentPath(segment uint64) string {
+	return path.Join(s.directory, fmt.Sprintf("%020d%s", segment, segmentFileSuffix))
+}
+
+func (s *SegmentedLogEventStore) Find(ctx context.Context, id ID) (EventWithMetadataSlice, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	locations, ok := s.index[id]
+	if !ok {
+		return nil, eventStoreError{
+			isMissingAggregate: true,
+			error:              fmt.Errorf("cannot find events for id %v in segmented log", id)}
+	}
+	return s.readRecords(locations)
+}
+
+func (s *SegmentedLogEventStore) FindFrom(ctx context.Context, id ID, fromSequence uint64) (EventWithMetadataSlice, error) {
+	return s.FindRange(ctx, id, fromSequence, math.MaxUint64)
+}
+
+func (s *SegmentedLogEventStore) FindRange(ctx context.Context, id ID, fromSequence uint64, toSequence uint64) (EventWithMetadataSlice, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	locations, ok := s.index[id]
+	if !ok {
+		return nil, eventStoreError{
+			isMissingAggregate: true,
+			error:              fmt.Errorf("cannot find events for id %v in segmented log", id)}
+	}
+	from, to := sequenceRange(len(locations), func(i int) uint64 { return locations[i].Sequence }, fromSequence, toSequence)
+	return s.readRecords(locations[from:to])
+}
+
+func (s *SegmentedLogEventStore) ReadAll(ctx context.Context, fromPosition uint64, limit int) (EventWithMetadataSlice, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	from, to := positionRange(uint64(len(s.log)), fromPosition, limit)
+	return s.readRecords(s.log[from:to])
+}
+
+func (s *SegmentedLogEventStore) LastPosition(ctx context.Context) (uint64, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return uint64(len(s.log)), nil
+}
+
+func (s *SegmentedLogEventStore) readRecords(locations []recordLocation) (EventWithMetadataSlice, error) {
+	events := make(EventWithMetadataSlice, len(locations))
+	for i, location := range locations {
+		event, _, err := s.readRecord(location.Segment, location.Offset)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot read record at %d:%d", location.Segment, location.Offset)
+		}
+		events[i] = event
+	}
+	return events, nil
+}
+
+// readRecord reads the record at offset in segment and returns the event and the size of the record.
+func (s *SegmentedLogEventStore) readRecord(segment uint64, offset int64) (EventWithMetadata, int64, error) {
+	data, err := s.readRecordData(segment, offset)
+	if err != nil {
+		return EventWithMetadata{}, 0, err
+	}
+	event, err := s.registry.Unmarshal(data)
+	return event, int64(recordHeaderSize + len(data)), err
+}
+
+// readRecordData reads the payload of the record at offset in segment and verifies its checksum.
+func (s *SegmentedLogEventStore) readRecordData(segment uint64, offset int64) ([]byte, error) {
+	f, ok := s.segments[segment]
+	if !ok {
+		return nil, fmt.Errorf("segment %d does not exist", segment)
+	}
+	header := make([]byte, recordHeaderSize)
+	if _, err := f.ReadAt(header, offset); err != nil {
+		return nil, err
+	}
+	length := int64(binary.BigEndian.Uint32(header[:4]))
+	if offset+recordHeaderSize+length > s.sizes[segment] {
+		return nil, io.ErrUnexpectedEOF
+	}
+	data := make([]byte, length)
+	if _, err := f.ReadAt(data, offset+recordHeaderSize); err != nil {
+		return nil, err
+	}
+	if crc32.Checksum(data, crcTable) != binary.BigEndian.Uint32(header[4:]) {
+		return nil, errors.New("record checksum mismatch")
+	}
+	return data, nil
+}
+
+func (s *SegmentedLogEventStore) Persist(ctx context.Context, id ID, expectedVersion uint64, events EventWithMetadataSlice) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	var currentVersion uint64
+	if locations := s.index[id]; len(locations) != 0 {
+		currentVersion = locations[len(locations)-1].Sequence
+	}
+	if currentVersion != expectedVersion {
+		return concurrencyConflictError(id, expectedVersion, currentVersion)
+	}
+	if err := validateEvents(id, expectedVersion, events); err != nil {
+		return err
+	}
+	if len(events) == 0 {
+		return nil
+	}
+
+	if s.sizes[s.activeSegment] >= s.maxSegmentSize {
+		if err := s.roll(); err != nil {
+			return err
+		}
+	}
+
+	buf := make([]byte, 0, 512)
+	entries := make([]indexEntry, len(events))
+	offset := s.sizes[s.activeSegment]
+	for i, event := range events {
+		event.Position = uint64(len(s.log)+i) + 1
+		data, err := s.registry.Marshal(event)
+		if err != nil {
+			return errors.Wrapf(err, "cannot marshal event to persist %v", event)
+		}
+		entries[i] = indexEntry{id, recordLocation{event.Sequence, s.activeSegment, offset + int64(len(buf)), events[0].Sequence}}
+
+		var header [recordHeaderSize]byte
+		binary.BigEndian.PutUint32(header[:4], uint32(len(data)))
+		binary.BigEndian.PutUint32(header[4:], crc32.Checksum(data, crcTable))
+		buf = append(append(buf, header[:]...), data...)
+	}
+
+	active := s.segments[s.activeSegment]
+	if _, err := active.WriteAt(buf, offset); err != nil {
+		active.Truncate(offset)
+		return errors.Wrapf(err, "cannot append events for id %v", id)
+	}
+	if err := active.Sync(); err != nil {
+		active.Truncate(offset)
+		return errors.Wrapf(err, "cannot sync segment %d", s.activeSegment)
+	}
+	if err := s.appendIndex(entries); err != nil {
+		active.Truncate(offset)
+		return err
+	}
+	s.sizes[s.activeSegment] = offset + int64(len(buf))
+	s.notify()
+	return nil
+}
+
+func (s *SegmentedLogEventStore) roll() error {
+	next := s.activeSegment + 1
+	f, err := os.OpenFile(s.segmentPath(next), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "cannot create segment %d", next)
+	}
+	s.segments[next] = f
+	s.activeSegment = next
+	s.sizes[next] = 0
+	return nil
+}
+
+func (s *SegmentedLogEventStore) appendIndex(entries []indexEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	var buf []byte
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		buf = append(append(buf, line...), '\n')
+	}
+	if _, err := s.indexFile.WriteAt(buf, s.indexSize); err != nil {
+		s.indexFile.Truncate(s.indexSize)
+		return errors.Wrap(err, "cannot write index")
+	}
+	if err := s.indexFile.Sync(); err != nil {
+		s.indexFile.Truncate(s.indexSize)
+		return errors.Wrap(err, "cannot sync index")
+	}
+	s.indexSize += int64(len(buf))
+	for _, entry := range entries {
+		s.index[entry.ID] = append(s.index[entry.ID], entry.recordLocation)
+		s.log = append(s.log, entry.recordLocation)
+	}
+	return nil
+}
+
+// Close closes the segment and index files.
+func (s *SegmentedLogEventStore) Close() error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	var firstErr error
+	for _, f := range s.segments {
+		if err := f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if s.indexFile != nil {
+		if err := s.indexFile.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// UpgradeEventsTo copies every event, in the order it was appended, into a new segmented log in directory with
+// the latest schema versions registered with the EventRegistry of the store. Events persisted together are
+// persisted together again; for records indexed before batches were recorded, consecutive events of an ID with
+// consecutive sequences recorded at the same time in the same segment are taken to be a batch. Segments cannot be
+// rewritten in place, so this log is left as is: replace its directory with directory while no process uses
+// either. It returns the number of copied events.
+func (s *SegmentedLogEventStore) UpgradeEventsTo(ctx context.Context, directory string) (int, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	upgraded, err := NewSegmentedLogEventStore(directory, s.maxSegmentSize, WithEventRegistry(s.registry))
+	if err != nil {
+		return 0, err
+	}
+	defer upgraded.Close()
+
+	var copied int
+	var batch EventWithMetadataSlice
+	var batchLocation recordLocation
+	persistBatch := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := upgraded.Persist(ctx, batch[0].ID, batch[0].Sequence-1, batch); err != nil {
+			return err
+		}
+		copied += len(batch)
+		batch = nil
+		return nil
+	}
+	for _, location := range s.log {
+		if err := ctx.Err(); err != nil {
+			return copied, err
+		}
+		event, _, err := s.readRecord(location.Segment, location.Offset)
+		if err != nil {
+			return copied, errors.Wrapf(err, "cannot read record at %d:%d", location.Segment, location.Offset)
+		}
+		if len(batch) != 0 && !sameBatch(batch[len(batch)-1], batchLocation, event, location) {
+			if err := persistBatch(); err != nil {
+				return copied, err
+			}
+		}
+		batch, batchLocation = append(batch, event), location
+	}
+	if err := persistBatch(); err != nil {
+		return copied, err
+	}
+	return copied, nil
+}
+
+// sameBatch reports whether the event at next was persisted along with the event at last that precedes it.
+func sameBatch(last EventWithMetadata, lastLocation recordLocation, next EventWithMetadata, nextLocation recordLocation) bool {
+	if next.ID != last.ID || next.Sequence != last.Sequence+1 {
+		return false
+	}
+	if lastLocation.Batch != 0 || nextLocation.Batch != 0 {
+		return nextLocation.Batch == lastLocation.Batch
+	}
+	return nextLocation.Segment == lastLocation.Segment && next.RecordedAt.Equal(last.RecordedAt)
+}
@@ -0,0 +1,253 @@
+package blob
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSegmentedLogEventStoreReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "segmentedlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	store, err := NewSegmentedLogEventStore(dir, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	one := wrap("1", 1, CreatedEvent{BlobType: "text/plain", Data: []byte("one")}, TagsAddedEvent{"a": "b"})
+	two := wrap("2", 1, CreatedEvent{BlobType: "text/plain", Data: []byte("two")})
+	deleted := wrap("1", 3, DeletedEvent{})
+	for _, events := range []EventWithMetadataSlice{one, two, deleted} {
+		if err := store.Persist(ctx, events[0].ID, events[0].Sequence-1, events); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := map[ID]EventWithMetadataSlice{
+		"1": append(positioned(one, 1), positioned(deleted, 4)...),
+		"2": positioned(two, 3),
+	}
+	store.Close()
+
+	segments, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) < 3 {
+		t.Fatalf("Expected the segments to roll over but found %d files", len(segments))
+	}
+
+	// Simulate a crash after writing a partial record to the active segment.
+	f, err := os.OpenFile(path.Join(dir, segments[len(segments)-2].Name()), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 0, 42, 1, 2})
+	f.Close()
+
+	store, err = NewSegmentedLogEventStore(dir, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	for id, events := range expected {
+		found, err := store.Find(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(found, events) {
+			t.Fatalf("Expected events %#v but got %#v", events, found)
+		}
+	}
+	if err := store.Persist(ctx, "2", 1, wrap("2", 2, RestoredEvent{})); err != nil {
+		t.Fatal(err)
+	}
+	all, err := store.ReadAll(ctx, 4, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEvents(t, all, append(positioned(deleted, 4), positioned(wrap("2", 2, RestoredEvent{}), 5)...))
+}
+
+func TestSegmentedLogEventStoreRecover(t *testing.T) {
+	tests := map[string]struct {
+		// Corrupt changes the only segment of a log whose index was lost.
+		Corrupt       func(segment []byte) []byte
+		ExpectedError bool
+	}{
+		"partially written final record": {
+			Corrupt: func(segment []byte) []byte { return append(segment, 0, 0, 0, 42, 1, 2) },
+		},
+		"final record with a checksum mismatch": {
+			Corrupt: func(segment []byte) []byte { return append(segment, 0, 0, 0, 3, 0, 0, 0, 0, 1, 2, 3) },
+		},
+		"record with a checksum mismatch before the final record": {
+			Corrupt: func(segment []byte) []byte {
+				segment[recordHeaderSize] ^= 0xff
+				return segment
+			},
+			ExpectedError: true,
+		},
+	}
+
+	for testName, data := range tests {
+		t.Run(testName, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "segmentedlog")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			ctx := context.Background()
+			store, err := NewSegmentedLogEventStore(dir, 1<<20)
+			if err != nil {
+				t.Fatal(err)
+			}
+			events := wrap("1", 1, CreatedEvent{BlobType: "text/plain"}, TagsAddedEvent{"a": "b"})
+			if err := store.Persist(ctx, "1", 0, events); err != nil {
+				t.Fatal(err)
+			}
+			store.Close()
+
+			segmentPath := store.segmentPath(0)
+			segment, err := ioutil.ReadFile(segmentPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(segmentPath, data.Corrupt(segment), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Truncate(path.Join(dir, indexFileName), 0); err != nil {
+				t.Fatal(err)
+			}
+
+			store, err = NewSegmentedLogEventStore(dir, 1<<20)
+			if data.ExpectedError {
+				if err == nil {
+					store.Close()
+					t.Fatal("Expected corruption before the final record to be an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+			found, err := store.Find(ctx, "1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertEvents(t, found, positioned(events, 1))
+			if info, err := os.Stat(segmentPath); err != nil || info.Size() != int64(len(segment)) {
+				t.Fatalf("Expected the final record to be truncated but got %v, '%v'", info, err)
+			}
+		})
+	}
+}
+
+// titledEvent is version 1 of versionedEvent.
+type titledEvent struct {
+	Title string
+}
+
+func (t titledEvent) Apply(b Blob) Blob {
+	return b
+}
+
+func TestSegmentedLogEventStoreUpgradeEventsTo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "segmentedlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	v1 := NewEventRegistry()
+	registerEvents(v1)
+	v1.MustRegister(titledEvent{}, EventType{Name: "test.versioned", SchemaVersion: 1, Codec: JSONCodec(titledEvent{})})
+	ctx := context.Background()
+	store, err := NewSegmentedLogEventStore(path.Join(dir, "v1"), 64, WithEventRegistry(v1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, events := range []EventWithMetadataSlice{
+		wrap("1", 1, CreatedEvent{BlobType: "text/plain"}, titledEvent{Title: "hello"}),
+		wrap("2", 1, CreatedEvent{BlobType: "text/plain"}),
+		wrap("1", 3, DeletedEvent{}),
+	} {
+		if err := store.Persist(ctx, events[0].ID, events[0].Sequence-1, events); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.Close()
+
+	registry := newVersionedEventRegistry()
+	store, err = NewSegmentedLogEventStore(path.Join(dir, "v1"), 64, WithEventRegistry(registry))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	copied, err := store.UpgradeEventsTo(ctx, path.Join(dir, "v2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if copied != 4 {
+		t.Fatalf("Expected 4 copied events but got %d", copied)
+	}
+
+	upgraded, err := NewSegmentedLogEventStore(path.Join(dir, "v2"), 64, WithEventRegistry(registry))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upgraded.Close()
+	all, err := upgraded.ReadAll(ctx, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := append(positioned(wrap("1", 1, CreatedEvent{BlobType: "text/plain"}, versionedEvent{Name: "hello"}), 1),
+		append(positioned(wrap("2", 1, CreatedEvent{BlobType: "text/plain"}), 3), positioned(wrap("1", 3, DeletedEvent{}), 4)...)...)
+	assertEvents(t, all, expected)
+
+	var batches []uint64
+	for _, location := range upgraded.log {
+		batches = append(batches, location.Batch)
+	}
+	if !reflect.DeepEqual(batches, []uint64{1, 1, 1, 3}) {
+		t.Fatalf("Expected the batches to be persisted as they were but got %v", batches)
+	}
+}
+
+func TestSameBatch(t *testing.T) {
+	recordedAt := time.Now()
+	first := EventWithMetadata{ID: "1", Sequence: 1, Metadata: Metadata{RecordedAt: recordedAt}}
+	second := EventWithMetadata{ID: "1", Sequence: 2, Metadata: Metadata{RecordedAt: recordedAt}}
+	later := EventWithMetadata{ID: "1", Sequence: 2, Metadata: Metadata{RecordedAt: recordedAt.Add(time.Millisecond)}}
+	tests := map[string]struct {
+		Next         EventWithMetadata
+		LastLocation recordLocation
+		NextLocation recordLocation
+		Expected     bool
+	}{
+		"same recorded batch":                  {second, recordLocation{Batch: 1}, recordLocation{Batch: 1}, true},
+		"next recorded batch":                  {second, recordLocation{Batch: 1}, recordLocation{Batch: 2}, false},
+		"legacy records recorded together":     {second, recordLocation{}, recordLocation{}, true},
+		"legacy records recorded apart":        {later, recordLocation{}, recordLocation{}, false},
+		"legacy records in different segments": {second, recordLocation{}, recordLocation{Segment: 1}, false},
+		"another aggregate":                    {EventWithMetadata{ID: "2", Sequence: 2}, recordLocation{Batch: 1}, recordLocation{Batch: 1}, false},
+	}
+	for testName, data := range tests {
+		t.Run(testName, func(t *testing.T) {
+			if actual := sameBatch(first, data.LastLocation, data.Next, data.NextLocation); actual != data.Expected {
+				t.Fatalf("Expected %v but got %v", data.Expected, actual)
+			}
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package blob
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// SnapshotStore stores the latest state of aggregates so they can be found without replaying all their events.
+type SnapshotStore interface {
+	// Load the latest snapshot for the aggregate ID.
+	// If there is no snapshot for the aggregate ID we return an error with IsMissingAggregate() true.
+	Load(context.Context, ID) (Blob, error)
+
+	// Save a snapshot of the aggregate unless a snapshot with a higher Sequence is already stored.
+	Save(context.Context, Blob) error
+}
+
+// SnapshotPolicy decides when AggregateRepository saves a snapshot.
+type SnapshotPolicy interface {
+	// ShouldSnapshot reports whether to snapshot b, which is the result of applying eventsSinceSnapshot
+	// to the latest snapshot.
+	ShouldSnapshot(b Blob, eventsSinceSnapshot EventWithMetadataSlice) bool
+}
+
+// SnapshotPolicyFunc adapts a function to a SnapshotPolicy.
+type SnapshotPolicyFunc func(Blob, EventWithMetadataSlice) bool
+
+func (f SnapshotPolicyFunc) ShouldSnapshot(b Blob, eventsSinceSnapshot EventWithMetadataSlice) bool {
+	return f(b, eventsSinceSnapshot)
+}
+
+// EveryNEvents snapshots once n events have been applied since the latest snapshot.
+func EveryNEvents(n int) SnapshotPolicy {
+	return SnapshotPolicyFunc(func(_ Blob, eventsSinceSnapshot EventWithMetadataSlice) bool {
+		return len(eventsSinceSnapshot) >= n
+	})
+}
+
+// OnSize snapshots once the events applied since the latest snapshot take up at least size bytes when marshaled
+// with registry, which should be the registry the event store was built with.
+func OnSize(registry *EventRegistry, size int) SnapshotPolicy {
+	return SnapshotPolicyFunc(func(_ Blob, eventsSinceSnapshot EventWithMetadataSlice) bool {
+		var total int
+		for _, event := range eventsSinceSnapshot {
+			eventType, err := registry.Lookup(event.Event)
+			if err != nil {
+				continue
+			}
+			data, err := eventType.Codec.Marshal(event.Event)
+			if err != nil {
+				continue
+			}
+			if total += len(data); total >= size {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// AnyOf snapshots when any of policies does.
+func AnyOf(policies ...SnapshotPolicy) SnapshotPolicy {
+	return SnapshotPolicyFunc(func(b Blob, eventsSinceSnapshot EventWithMetadataSlice) bool {
+		for _, policy := range policies {
+			if policy.ShouldSnapshot(b, eventsSinceSnapshot) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func missingSnapshotError(id ID) error {
+	return eventStoreError{isMissingAggregate: true, error: fmt.Errorf("cannot find snapshot for id %v", id)}
+}
+
+type InMemorySnapshotStore struct {
+	mux       *sync.Mutex
+	snapshots map[ID]Blob
+}
+
+func NewInMemorySnapshotStore() *InMemorySnapshotStore {
+	return &InMemorySnapshotStore{mux: new(sync.Mutex), snapshots: make(map[ID]Blob)}
+}
+
+func (i *InMemorySnapshotStore) Load(ctx context.Context, id ID) (Blob, error) {
+	i.mux.Lock()
+	defer i.mux.Unlock()
+
+	snapshot, ok := i.snapshots[id]
+	if !ok {
+		return Blob{}, missingSnapshotError(id)
+	}
+	return snapshot, nil
+}
+
+func (i *InMemorySnapshotStore) Save(ctx context.Context, b Blob) error {
+	i.mux.Lock()
+	defer i.mux.Unlock()
+
+	if existing, ok := i.snapshots[b.ID]; ok && existing.Sequence >= b.Sequence {
+		return nil
+	}
+	i.snapshots[b.ID] = b
+	return nil
+}
+
+// LocalFileSystemSnapshotStore stores the snapshot of each aggregate as a JSON file named after its ID.
+type LocalFileSystemSnapshotStore struct {
+	mux           *sync.Mutex
+	baseDirectory string
+}
+
+func NewLocalFileSystemSnapshotStore(baseDirectory string) (*LocalFileSystemSnapshotStore, error) {
+	if err := os.MkdirAll(baseDirectory, 0755); err != nil {
+		return nil, errors.Wrap(err, "cannot create snapshot directory")
+	}
+	return &LocalFileSystemSnapshotStore{mux: new(sync.Mutex), baseDirectory: baseDirectory}, nil
+}
+
+func (l *LocalFileSystemSnapshotStore) Load(ctx context.Context, id ID) (Blob, error) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return l.load(id)
+}
+
+func (l *LocalFileSystemSnapshotStore) load(id ID) (Blob, error) {
+	data, err := ioutil.ReadFile(l.snapshotPath(id))
+	if os.IsNotExist(err) {
+		return Blob{}, missingSnapshotError(id)
+	}
+	if err != nil {
+		return Blob{}, errors.Wrapf(err, "cannot read snapshot for id %v", id)
+	}
+	var snapshot Blob
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return Blob{}, errors.Wrapf(err, "cannot unmarshal snapshot for id %v", id)
+	}
+	return snapshot, nil
+}
+
+func (l *LocalFileSystemSnapshotStore) Save(ctx context.Context, b Blob) error {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	if existing, err := l.load(b.ID); err == nil && existing.Sequence >= b.Sequence {
+		return nil
+	}
+	data, err := json.Marshal(b)
+	if err != nil {
+		return errors.Wrapf(err, "cannot marshal snapshot for id %v", b.ID)
+	}
+
+	tempFile, err := ioutil.TempFile(l.baseDirectory, tempFilePrefix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+	_, err = tempFile.Write(data)
+	if err == nil {
+		err = tempFile.Sync()
+	}
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.Wrapf(err, "cannot write snapshot for id %v", b.ID)
+	}
+	if err := os.Rename(tempFile.Name(), l.snapshotPath(b.ID)); err != nil {
+		return errors.Wrapf(err, "cannot store snapshot for id %v", b.ID)
+	}
+	return syncDir(l.baseDirectory)
+}
+
+func (l *LocalFileSystemSnapshotStore) snapshotPath(id ID) string {
+	return path.Join(l.baseDirectory, id.String()+".json")
+}
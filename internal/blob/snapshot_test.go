@@ -0,0 +1,130 @@
+package blob
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/venkssa/eventsourcing/internal/platform"
+)
+
+func TestFindWithSnapshots(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshots")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fileSystemSnapshots, err := NewLocalFileSystemSnapshotStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshotStores := map[string]SnapshotStore{
+		"InMemorySnapshotStore":        NewInMemorySnapshotStore(),
+		"LocalFileSystemSnapshotStore": fileSystemSnapshots,
+	}
+
+	for storeName, snapshots := range snapshotStores {
+		t.Run(storeName, func(t *testing.T) {
+			ctx := context.Background()
+			store := NewInMemoryEventStore()
+			repo := NewAggregateRepository(store, WithSnapshots(snapshots, EveryNEvents(3)))
+
+			commands := []Command{
+				CreateCommand("1", "text/plain", []byte("hello")),
+				UpdateTagsCommand("1", Tags{"a": "1"}, nil),
+				UpdateCommand("1", []byte("world"), false),
+				UpdateTagsCommand("1", Tags{"a": "2", "b": "3"}, nil),
+			}
+			for _, cmd := range commands {
+				if _, err := repo.Process(ctx, cmd); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			snapshot, err := snapshots.Load(ctx, "1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if snapshot.Sequence != 3 {
+				t.Fatalf("Expected a snapshot at sequence 3 but was %v", snapshot.Sequence)
+			}
+			if _, err := snapshots.Load(ctx, "2"); !platform.IsMissingAggregate(err) {
+				t.Fatalf("Expected a missing snapshot but got '%v'", err)
+			}
+
+			blob, err := repo.Find(ctx, "1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			replayed, err := NewAggregateRepository(store).Find(ctx, "1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(blob, replayed) {
+				t.Fatalf("Expected %#v but was %#v", replayed, blob)
+			}
+		})
+	}
+}
+
+func TestFindWithSnapshotAheadOfEventStore(t *testing.T) {
+	ctx := context.Background()
+	snapshots := NewInMemorySnapshotStore()
+	store := NewInMemoryEventStore()
+	repo := NewAggregateRepository(store, WithSnapshots(snapshots, EveryNEvents(100)))
+
+	for _, cmd := range []Command{
+		CreateCommand("1", "text/plain", []byte("hello")),
+		UpdateTagsCommand("1", Tags{"a": "1"}, nil),
+	} {
+		if _, err := repo.Process(ctx, cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A snapshot taken before the event store was restored from an older backup.
+	if err := snapshots.Save(ctx, Blob{ID: "1", BlobType: "text/plain", Data: []byte("lost"), Sequence: 5}); err != nil {
+		t.Fatal(err)
+	}
+
+	blob, err := repo.Find(ctx, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayed, err := NewAggregateRepository(store).Find(ctx, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(blob, replayed) {
+		t.Fatalf("Expected the snapshot to be discarded and %#v but was %#v", replayed, blob)
+	}
+	if _, err := repo.FindAt(ctx, "1", 2); err != nil {
+		t.Fatal(err)
+	}
+
+	blob, err = repo.Process(ctx, UpdateCommand("1", []byte("world"), false))
+	if err != nil {
+		t.Fatalf("Expected the command to be processed against the event store but got '%v'", err)
+	}
+	if blob.Sequence != 3 || string(blob.Data) != "world" {
+		t.Fatalf("Expected sequence 3 with the updated data but got %#v", blob)
+	}
+}
+
+func TestOnSizeUsesTheRegistryOfTheStore(t *testing.T) {
+	registry := NewEventRegistry()
+	registry.MustRegister(renamedEvent{}, EventType{Name: "renamed", SchemaVersion: 1, Codec: JSONCodec(renamedEvent{})})
+	events := EventWithMetadataSlice{
+		{ID: "1", Sequence: 1, Event: renamedEvent{Name: "text/plain"}},
+		{ID: "1", Sequence: 2, Event: renamedEvent{Name: "text/html"}},
+	}
+
+	if !OnSize(registry, 30).ShouldSnapshot(Blob{}, events) {
+		t.Fatal("Expected events registered only with the registry of the store to count towards the size")
+	}
+	if OnSize(DefaultEventRegistry, 1).ShouldSnapshot(Blob{}, events) {
+		t.Fatal("Expected events missing from the registry not to count towards the size")
+	}
+}
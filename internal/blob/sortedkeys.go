@@ -0,0 +1,95 @@
+package blob
+
+import (
+	"sort"
+	"strings"
+)
+
+// sortedKeysChunkSize is the size a chunk of sortedKeys grows to before it is split in two.
+const sortedKeysChunkSize = 1024
+
+// sortedKeys is an ordered set of keys kept in chunks of sorted keys, so adding or removing a key only moves the
+// keys of one chunk and keys with a prefix are found with a binary search.
+type sortedKeys struct {
+	chunks [][]string
+}
+
+func newSortedKeys(keys []string) *sortedKeys {
+	sort.Strings(keys)
+	s := &sortedKeys{}
+	for start := 0; start < len(keys); start += sortedKeysChunkSize / 2 {
+		end := start + sortedKeysChunkSize/2
+		if end > len(keys) {
+			end = len(keys)
+		}
+		s.chunks = append(s.chunks, append([]string(nil), keys[start:end]...))
+	}
+	return s
+}
+
+// chunk returns the index of the chunk that holds or would hold the key.
+func (s *sortedKeys) chunk(key string) int {
+	i := sort.Search(len(s.chunks), func(i int) bool {
+		chunk := s.chunks[i]
+		return chunk[len(chunk)-1] >= key
+	})
+	if i == len(s.chunks) && i > 0 {
+		i--
+	}
+	return i
+}
+
+func (s *sortedKeys) add(key string) {
+	if len(s.chunks) == 0 {
+		s.chunks = [][]string{{key}}
+		return
+	}
+	i := s.chunk(key)
+	chunk := s.chunks[i]
+	j := sort.SearchStrings(chunk, key)
+	if j < len(chunk) && chunk[j] == key {
+		return
+	}
+	chunk = append(chunk, "")
+	copy(chunk[j+1:], chunk[j:])
+	chunk[j] = key
+
+	if len(chunk) < sortedKeysChunkSize {
+		s.chunks[i] = chunk
+		return
+	}
+	half := len(chunk) / 2
+	s.chunks = append(s.chunks, nil)
+	copy(s.chunks[i+2:], s.chunks[i+1:])
+	s.chunks[i] = chunk[:half:half]
+	s.chunks[i+1] = append([]string(nil), chunk[half:]...)
+}
+
+func (s *sortedKeys) remove(key string) {
+	if len(s.chunks) == 0 {
+		return
+	}
+	i := s.chunk(key)
+	chunk := s.chunks[i]
+	j := sort.SearchStrings(chunk, key)
+	if j == len(chunk) || chunk[j] != key {
+		return
+	}
+	if len(chunk) == 1 {
+		s.chunks = append(s.chunks[:i], s.chunks[i+1:]...)
+		return
+	}
+	s.chunks[i] = append(chunk[:j], chunk[j+1:]...)
+}
+
+// withPrefix calls fn with the keys with the prefix in ascending order until fn returns false.
+func (s *sortedKeys) withPrefix(prefix string, fn func(key string) bool) {
+	for i := s.chunk(prefix); i < len(s.chunks); i++ {
+		chunk := s.chunks[i]
+		for j := sort.SearchStrings(chunk, prefix); j < len(chunk); j++ {
+			if !strings.HasPrefix(chunk[j], prefix) || !fn(chunk[j]) {
+				return
+			}
+		}
+	}
+}
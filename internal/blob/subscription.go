@@ -0,0 +1,247 @@
+package blob
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// notifier lets subscribers wait for events persisted to an EventStore.
+type notifier struct {
+	mux     *sync.Mutex
+	changed chan struct{}
+}
+
+func newNotifier() *notifier {
+	return &notifier{mux: new(sync.Mutex), changed: make(chan struct{})}
+}
+
+// Changed returns a channel that is closed once events are persisted after the call.
+func (n *notifier) Changed() <-chan struct{} {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	return n.changed
+}
+
+func (n *notifier) notify() {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	close(n.changed)
+	n.changed = make(chan struct{})
+}
+
+// CheckpointStore stores the position of the last event each named subscriber has processed.
+type CheckpointStore interface {
+	// Load the checkpoint of the subscriber name, or 0 if it has none.
+	Load(ctx context.Context, name string) (uint64, error)
+	Save(ctx context.Context, name string, position uint64) error
+}
+
+type InMemoryCheckpointStore struct {
+	mux         *sync.Mutex
+	checkpoints map[string]uint64
+}
+
+func NewInMemoryCheckpointStore() *InMemoryCheckpointStore {
+	return &InMemoryCheckpointStore{mux: new(sync.Mutex), checkpoints: make(map[string]uint64)}
+}
+
+func (i *InMemoryCheckpointStore) Load(ctx context.Context, name string) (uint64, error) {
+	i.mux.Lock()
+	defer i.mux.Unlock()
+	return i.checkpoints[name], nil
+}
+
+func (i *InMemoryCheckpointStore) Save(ctx context.Context, name string, position uint64) error {
+	i.mux.Lock()
+	defer i.mux.Unlock()
+	i.checkpoints[name] = position
+	return nil
+}
+
+// LocalFileSystemCheckpointStore stores each checkpoint in a file named after the subscriber.
+type LocalFileSystemCheckpointStore struct {
+	mux           *sync.Mutex
+	baseDirectory string
+}
+
+func NewLocalFileSystemCheckpointStore(baseDirectory string) (*LocalFileSystemCheckpointStore, error) {
+	if err := os.MkdirAll(baseDirectory, 0755); err != nil {
+		return nil, errors.Wrap(err, "cannot create checkpoint directory")
+	}
+	return &LocalFileSystemCheckpointStore{mux: new(sync.Mutex), baseDirectory: baseDirectory}, nil
+}
+
+func (l *LocalFileSystemCheckpointStore) Load(ctx context.Context, name string) (uint64, error) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	data, err := ioutil.ReadFile(path.Join(l.baseDirectory, name))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, errors.Wrapf(err, "cannot read checkpoint %v", name)
+	}
+	position, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "corrupt checkpoint %v", name)
+	}
+	return position, nil
+}
+
+func (l *LocalFileSystemCheckpointStore) Save(ctx context.Context, name string, position uint64) error {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	tempFile, err := ioutil.TempFile(l.baseDirectory, tempFilePrefix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+	if _, err := tempFile.WriteString(strconv.FormatUint(position, 10)); err != nil {
+		tempFile.Close()
+		return errors.Wrapf(err, "cannot write checkpoint %v", name)
+	}
+	if err := tempFile.Sync(); err != nil {
+		tempFile.Close()
+		return errors.Wrapf(err, "cannot write checkpoint %v", name)
+	}
+	if err := tempFile.Close(); err != nil {
+		return errors.Wrapf(err, "cannot write checkpoint %v", name)
+	}
+	return os.Rename(tempFile.Name(), path.Join(l.baseDirectory, name))
+}
+
+// SubscriptionOptions configures a Subscription.
+type SubscriptionOptions struct {
+	// Name identifies the checkpoint of the subscriber in Checkpoints.
+	// Without a Name or Checkpoints the subscription starts at FromPosition and Ack is a no-op.
+	Name        string
+	Checkpoints CheckpointStore
+	// FromPosition is the position of the first event delivered to a subscriber without a checkpoint.
+	FromPosition uint64
+	// Filter skips the events for which it returns false. Skipped events are never delivered.
+	Filter func(EventWithMetadata) bool
+	// BatchSize is the number of events read from the store at a time while catching up.
+	BatchSize int
+	// BufferSize is the number of events read ahead of the subscriber.
+	BufferSize int
+}
+
+const defaultSubscriptionBatchSize = 100
+
+// Subscription delivers the events of an EventStore in position order. It first catches up with the events
+// persisted after the subscriber's checkpoint and then delivers events as they are persisted.
+//
+// Delivery is at-least-once: the checkpoint only advances when the subscriber calls Ack, so events delivered
+// but not acknowledged are delivered again by the next subscription with the same Name. A slow subscriber
+// only delays its own subscription; events are read from the store as the subscriber receives them, never
+// buffered beyond BufferSize.
+type Subscription struct {
+	opts   SubscriptionOptions
+	events chan EventWithMetadata
+	cancel context.CancelFunc
+	done   chan struct{}
+	err    error
+}
+
+// Subscribe starts a subscription to store. It stops when ctx is done or Close is called.
+func Subscribe(ctx context.Context, store EventStore, opts SubscriptionOptions) (*Subscription, error) {
+	from := opts.FromPosition
+	if opts.Name != "" && opts.Checkpoints != nil {
+		checkpoint, err := opts.Checkpoints.Load(ctx, opts.Name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot load checkpoint for subscription %v", opts.Name)
+		}
+		if checkpoint != 0 {
+			from = checkpoint + 1
+		}
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultSubscriptionBatchSize
+	}
+	if opts.BufferSize < 0 {
+		opts.BufferSize = 0
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	s := &Subscription{
+		opts:   opts,
+		events: make(chan EventWithMetadata, opts.BufferSize),
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go s.run(ctx, store, from)
+	return s, nil
+}
+
+func (s *Subscription) run(ctx context.Context, store EventStore, position uint64) {
+	defer close(s.done)
+	defer close(s.events)
+
+	for {
+		// Take the channel before reading so events persisted while delivering are not missed.
+		changed := store.Changed()
+		events, err := store.ReadAll(ctx, position, s.opts.BatchSize)
+		if err != nil {
+			s.err = errors.Wrapf(err, "cannot read events from position %d", position)
+			return
+		}
+		for _, event := range events {
+			position = event.Position + 1
+			if s.opts.Filter != nil && !s.opts.Filter(event) {
+				continue
+			}
+			select {
+			case s.events <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+		if len(events) == s.opts.BatchSize {
+			continue
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Events returns the channel events are delivered on. It is closed when the subscription stops.
+func (s *Subscription) Events() <-chan EventWithMetadata {
+	return s.events
+}
+
+// Ack records that the subscriber has processed event and all events before it.
+func (s *Subscription) Ack(ctx context.Context, event EventWithMetadata) error {
+	if s.opts.Name == "" || s.opts.Checkpoints == nil {
+		return nil
+	}
+	if err := s.opts.Checkpoints.Save(ctx, s.opts.Name, event.Position); err != nil {
+		return errors.Wrapf(err, "cannot save checkpoint for subscription %v", s.opts.Name)
+	}
+	return nil
+}
+
+// Close stops the subscription and waits for it to finish.
+func (s *Subscription) Close() error {
+	s.cancel()
+	for range s.events {
+	}
+	<-s.done
+	return s.Err()
+}
+
+// Err returns the error that stopped the subscription, if any. It is only valid once Events is closed.
+func (s *Subscription) Err() error {
+	return s.err
+}
@@ -0,0 +1,100 @@
+package blob
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func receive(t *testing.T, s *Subscription) EventWithMetadata {
+	select {
+	case event, ok := <-s.Events():
+		if !ok {
+			t.Fatalf("Expected an event but the subscription stopped with '%v'", s.Err())
+		}
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("Expected an event but got none")
+	}
+	return EventWithMetadata{}
+}
+
+func TestSubscriptionCatchesUpAndResumesFromCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoints")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	checkpoints, err := NewLocalFileSystemCheckpointStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	store := NewInMemoryEventStore()
+	if err := store.Persist(ctx, "1", 0, wrap("1", 1, CreatedEvent{BlobType: "text/plain"}, TagsAddedEvent{"a": "b"})); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := SubscriptionOptions{Name: "test", Checkpoints: checkpoints, BatchSize: 1}
+	subscription, err := Subscribe(ctx, store, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for expected := uint64(1); expected <= 2; expected++ {
+		if event := receive(t, subscription); event.Position != expected {
+			t.Fatalf("Expected position %d but got %d", expected, event.Position)
+		}
+	}
+
+	// A slow subscriber does not hold up writers.
+	for sequence := uint64(3); sequence <= 5; sequence++ {
+		if err := store.Persist(ctx, "1", sequence-1, wrap("1", sequence, TagsAddedEvent{"a": "b"})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	event := receive(t, subscription)
+	if event.Position != 3 {
+		t.Fatalf("Expected live event at position 3 but got %d", event.Position)
+	}
+	if err := subscription.Ack(ctx, event); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, subscription)
+	if err := subscription.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Events delivered after the last Ack are delivered again.
+	subscription, err = Subscribe(ctx, store, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subscription.Close()
+	if event := receive(t, subscription); event.Position != 4 {
+		t.Fatalf("Expected to resume at position 4 but got %d", event.Position)
+	}
+}
+
+func TestSubscriptionFilter(t *testing.T) {
+	ctx := context.Background()
+	store := NewInMemoryEventStore()
+	subscription, err := Subscribe(ctx, store, SubscriptionOptions{
+		Filter: func(e EventWithMetadata) bool { return e.ID == "2" },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subscription.Close()
+
+	for _, id := range []ID{"1", "2"} {
+		if err := store.Persist(ctx, id, 0, wrap(id, 1, CreatedEvent{BlobType: "text/plain"})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if event := receive(t, subscription); event.ID != "2" {
+		t.Fatalf("Expected only events of 2 but got %v", event.ID)
+	}
+}
@@ -0,0 +1,349 @@
+package blob
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// MaxUploadParts is the most parts an upload can have.
+const MaxUploadParts = 10000
+
+const (
+	uploadSessionFileName = "session.json"
+	uploadPartFileSuffix  = ".part"
+)
+
+// UploadSession is an upload of the data of a blob in numbered parts. Payload refers to the assembled parts once
+// the upload is completed.
+type UploadSession struct {
+	UploadID  string `json:"uploadId"`
+	ID        `json:"id"`
+	BlobType  `json:"blobType"`
+	CreatedAt time.Time   `json:"createdAt"`
+	Payload   *PayloadRef `json:"payload,omitempty"`
+}
+
+type UploadPart struct {
+	Number int   `json:"number"`
+	Size   int64 `json:"size"`
+}
+
+// LocalFileSystemUploadStore stages the parts of each upload session in a directory named after its upload ID
+// until the session is removed. Uploading a part again replaces it, so a dropped part can be retried. Changes to
+// sessions are serialized so parts are never staged while a session is completed or removed. A session is marked
+// as completing while its parts are assembled, which is done without holding up changes to other sessions.
+type LocalFileSystemUploadStore struct {
+	mux           *sync.Mutex
+	baseDirectory string
+	// completing holds the upload IDs of the sessions whose parts are being assembled.
+	completing map[string]bool
+}
+
+func NewLocalFileSystemUploadStore(baseDirectory string) (*LocalFileSystemUploadStore, error) {
+	if err := os.MkdirAll(baseDirectory, 0755); err != nil {
+		return nil, errors.Wrap(err, "cannot create upload directory")
+	}
+	return &LocalFileSystemUploadStore{mux: new(sync.Mutex), baseDirectory: baseDirectory, completing: make(map[string]bool)}, nil
+}
+
+// Initiate starts an upload session for the data of the blob with the given ID and BlobType.
+func (l *LocalFileSystemUploadStore) Initiate(ctx context.Context, id ID, blobType BlobType) (UploadSession, error) {
+	if id == "" {
+		return UploadSession{}, errEmptyID
+	}
+	uploadID, err := newUUID()
+	if err != nil {
+		return UploadSession{}, err
+	}
+	session := UploadSession{UploadID: uploadID, ID: id, BlobType: blobType, CreatedAt: time.Now().UTC()}
+
+	if err := os.Mkdir(l.sessionPath(uploadID), 0755); err != nil {
+		return UploadSession{}, errors.Wrapf(err, "cannot create upload session for id %v", id)
+	}
+	if err := l.writeSession(session); err != nil {
+		os.RemoveAll(l.sessionPath(uploadID))
+		return UploadSession{}, err
+	}
+	return session, nil
+}
+
+// Session returns the upload session and the parts uploaded so far, in order. If the session cannot be found we
+// return an error with IsMissingAggregate() true.
+func (l *LocalFileSystemUploadStore) Session(ctx context.Context, id ID, uploadID string) (UploadSession, []UploadPart, error) {
+	session, err := l.session(id, uploadID)
+	if err != nil {
+		return UploadSession{}, nil, err
+	}
+	parts, err := l.parts(uploadID)
+	return session, parts, err
+}
+
+// PutPart stages part number of the upload with the data read from r. The data is written to a temporary file
+// first so only moving it into the session is serialized with the other changes to sessions.
+func (l *LocalFileSystemUploadStore) PutPart(ctx context.Context, id ID, uploadID string, number int, r io.Reader) (UploadPart, error) {
+	if number < 1 || number > MaxUploadParts {
+		return UploadPart{}, commandError(fmt.Sprintf("part number should be between 1 and %d", MaxUploadParts))
+	}
+	l.mux.Lock()
+	_, err := l.openSession(id, uploadID)
+	l.mux.Unlock()
+	if err != nil {
+		return UploadPart{}, err
+	}
+
+	tempFile, err := ioutil.TempFile(l.baseDirectory, tempFilePrefix)
+	if err != nil {
+		return UploadPart{}, err
+	}
+	defer os.Remove(tempFile.Name())
+	size, err := io.Copy(tempFile, r)
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return UploadPart{}, errors.Wrapf(err, "cannot write part %d of upload %v", number, uploadID)
+	}
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if _, err := l.openSession(id, uploadID); err != nil {
+		return UploadPart{}, err
+	}
+	if err := os.Rename(tempFile.Name(), l.partPath(uploadID, number)); err != nil {
+		return UploadPart{}, errors.Wrapf(err, "cannot stage part %d of upload %v", number, uploadID)
+	}
+	return UploadPart{Number: number, Size: size}, nil
+}
+
+// Complete assembles the parts of the upload, which have to be numbered from 1 without gaps, into a payload in
+// payloads. The payload is recorded in the session and the parts are removed, so completing the upload again
+// returns the same payload without assembling it. The session is kept until it is removed with Remove, which
+// should be done once the payload is used.
+func (l *LocalFileSystemUploadStore) Complete(ctx context.Context, id ID, uploadID string, payloads PayloadStore) (UploadSession, PayloadRef, error) {
+	session, parts, err := l.startCompleting(ctx, id, uploadID)
+	if err != nil || session.Payload != nil {
+		return session, payloadOf(session), err
+	}
+	defer func() {
+		l.mux.Lock()
+		delete(l.completing, uploadID)
+		l.mux.Unlock()
+	}()
+
+	readers := make([]io.Reader, len(parts))
+	for i, part := range parts {
+		if part.Number != i+1 {
+			return UploadSession{}, PayloadRef{}, commandError(fmt.Sprintf("upload %v is missing part %d", uploadID, i+1))
+		}
+		f, err := os.Open(l.partPath(uploadID, part.Number))
+		if err != nil {
+			return UploadSession{}, PayloadRef{}, errors.Wrapf(err, "cannot open part %d of upload %v", part.Number, uploadID)
+		}
+		defer f.Close()
+		readers[i] = f
+	}
+
+	ref, err := payloads.Put(ctx, io.MultiReader(readers...))
+	if err != nil {
+		return UploadSession{}, PayloadRef{}, errors.Wrapf(err, "cannot assemble upload %v", uploadID)
+	}
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	session.Payload = &ref
+	if err := l.writeSession(session); err != nil {
+		return UploadSession{}, PayloadRef{}, err
+	}
+	for _, part := range parts {
+		os.Remove(l.partPath(uploadID, part.Number))
+	}
+	return session, ref, nil
+}
+
+// startCompleting returns the session and its parts and marks it as completing, unless it is completed already.
+// Parts cannot be staged and the session cannot be removed while it is completing.
+func (l *LocalFileSystemUploadStore) startCompleting(ctx context.Context, id ID, uploadID string) (UploadSession, []UploadPart, error) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	session, parts, err := l.Session(ctx, id, uploadID)
+	if err != nil {
+		return UploadSession{}, nil, err
+	}
+	if session.Payload != nil {
+		return session, nil, nil
+	}
+	if l.completing[uploadID] {
+		return UploadSession{}, nil, errUploadCompleting(uploadID)
+	}
+	if len(parts) == 0 {
+		return UploadSession{}, nil, commandError(fmt.Sprintf("upload %v does not have any parts", uploadID))
+	}
+	l.completing[uploadID] = true
+	return session, parts, nil
+}
+
+func payloadOf(session UploadSession) PayloadRef {
+	if session.Payload == nil {
+		return PayloadRef{}
+	}
+	return *session.Payload
+}
+
+// Remove removes the upload session and its parts, either to abort the upload or once its payload is used.
+func (l *LocalFileSystemUploadStore) Remove(ctx context.Context, id ID, uploadID string) error {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	if _, err := l.session(id, uploadID); err != nil {
+		return err
+	}
+	if l.completing[uploadID] {
+		return errUploadCompleting(uploadID)
+	}
+	return os.RemoveAll(l.sessionPath(uploadID))
+}
+
+// Expire removes the upload sessions that have not changed since before, and returns how many it removed.
+// A session changes whenever it is initiated, a part is staged or it is completed.
+func (l *LocalFileSystemUploadStore) Expire(ctx context.Context, before time.Time) (int, error) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	files, err := ioutil.ReadDir(l.baseDirectory)
+	if err != nil {
+		return 0, errors.Wrap(err, "cannot list upload sessions")
+	}
+	var expired int
+	for _, file := range files {
+		if !file.ModTime().Before(before) {
+			continue
+		}
+		if file.IsDir() && (validateUploadID(file.Name()) != nil || l.completing[file.Name()]) {
+			continue
+		}
+		if !file.IsDir() && !strings.HasPrefix(file.Name(), tempFilePrefix) {
+			continue
+		}
+		if err := os.RemoveAll(path.Join(l.baseDirectory, file.Name())); err != nil {
+			return expired, errors.Wrapf(err, "cannot remove expired upload session %v", file.Name())
+		}
+		if file.IsDir() {
+			expired++
+		}
+	}
+	return expired, nil
+}
+
+// openSession returns the session if it has not been completed yet and is not being completed.
+func (l *LocalFileSystemUploadStore) openSession(id ID, uploadID string) (UploadSession, error) {
+	session, err := l.session(id, uploadID)
+	if err != nil {
+		return UploadSession{}, err
+	}
+	if session.Payload != nil {
+		return UploadSession{}, commandError(fmt.Sprintf("upload %v is already completed", uploadID))
+	}
+	if l.completing[uploadID] {
+		return UploadSession{}, errUploadCompleting(uploadID)
+	}
+	return session, nil
+}
+
+// writeSession writes the session to a temporary file and renames it into place.
+func (l *LocalFileSystemUploadStore) writeSession(session UploadSession) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return errors.Wrapf(err, "cannot marshal upload session %v", session.UploadID)
+	}
+	tempFile, err := ioutil.TempFile(l.sessionPath(session.UploadID), tempFilePrefix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+	_, err = tempFile.Write(data)
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tempFile.Name(), path.Join(l.sessionPath(session.UploadID), uploadSessionFileName))
+	}
+	return errors.Wrapf(err, "cannot write upload session %v", session.UploadID)
+}
+
+func (l *LocalFileSystemUploadStore) session(id ID, uploadID string) (UploadSession, error) {
+	if err := validateUploadID(uploadID); err != nil {
+		return UploadSession{}, err
+	}
+	data, err := ioutil.ReadFile(path.Join(l.sessionPath(uploadID), uploadSessionFileName))
+	if os.IsNotExist(err) {
+		return UploadSession{}, missingUploadError(id, uploadID)
+	}
+	if err != nil {
+		return UploadSession{}, errors.Wrapf(err, "cannot read upload session %v", uploadID)
+	}
+	var session UploadSession
+	if err := json.Unmarshal(data, &session); err != nil {
+		return UploadSession{}, errors.Wrapf(err, "cannot unmarshal upload session %v", uploadID)
+	}
+	if session.ID != id {
+		return UploadSession{}, missingUploadError(id, uploadID)
+	}
+	return session, nil
+}
+
+func (l *LocalFileSystemUploadStore) parts(uploadID string) ([]UploadPart, error) {
+	files, err := ioutil.ReadDir(l.sessionPath(uploadID))
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot list parts of upload %v", uploadID)
+	}
+	var parts []UploadPart
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), uploadPartFileSuffix) {
+			continue
+		}
+		number, err := strconv.Atoi(strings.TrimSuffix(file.Name(), uploadPartFileSuffix))
+		if err != nil {
+			continue
+		}
+		parts = append(parts, UploadPart{Number: number, Size: file.Size()})
+	}
+	sort.Slice(parts, func(i, j int) bool { return parts[i].Number < parts[j].Number })
+	return parts, nil
+}
+
+func (l *LocalFileSystemUploadStore) sessionPath(uploadID string) string {
+	return path.Join(l.baseDirectory, uploadID)
+}
+
+func (l *LocalFileSystemUploadStore) partPath(uploadID string, number int) string {
+	return path.Join(l.sessionPath(uploadID), strconv.Itoa(number)+uploadPartFileSuffix)
+}
+
+func errUploadCompleting(uploadID string) error {
+	return commandError(fmt.Sprintf("upload %v is being completed", uploadID))
+}
+
+func missingUploadError(id ID, uploadID string) error {
+	return eventStoreError{isMissingAggregate: true, error: fmt.Errorf("cannot find upload %v for id %v", uploadID, id)}
+}
+
+// validateUploadID checks that uploadID is a UUID so it is safe to use as a directory name.
+func validateUploadID(uploadID string) error {
+	if len(uploadID) != 36 || strings.Trim(uploadID, "0123456789abcdef-") != "" {
+		return commandError(fmt.Sprintf("invalid upload id %q", uploadID))
+	}
+	return nil
+}
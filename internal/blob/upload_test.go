@@ -0,0 +1,256 @@
+package blob
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/venkssa/eventsourcing/internal/platform"
+)
+
+func TestLocalFileSystemUploadStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uploads")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	uploads, err := NewLocalFileSystemUploadStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payloads := NewInMemoryPayloadStore()
+	ctx := context.Background()
+
+	session, err := uploads.Initiate(ctx, "1", "text/plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for number, data := range map[int]string{2: "world", 1: "hello ", 3: "dropped"} {
+		if _, err := uploads.PutPart(ctx, "1", session.UploadID, number, bytes.NewReader([]byte(data))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Retrying a part replaces it.
+	if _, err := uploads.PutPart(ctx, "1", session.UploadID, 3, bytes.NewReader([]byte("!"))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := uploads.PutPart(ctx, "1", session.UploadID, 0, bytes.NewReader(nil)); !platform.CommandError(err) {
+		t.Fatalf("Expected part number 0 to be a command error but got '%v'", err)
+	}
+	if _, _, err := uploads.Session(ctx, "2", session.UploadID); !platform.IsMissingAggregate(err) {
+		t.Fatalf("Expected the upload of another id to be missing but got '%v'", err)
+	}
+
+	_, parts, err := uploads.Session(ctx, "1", session.UploadID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parts) != 3 || parts[0].Number != 1 || parts[2].Size != 1 {
+		t.Fatalf("Expected 3 ordered parts but got %v", parts)
+	}
+
+	completed, ref, err := uploads.Complete(ctx, "1", session.UploadID, payloads)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if completed.Payload == nil || ref.Digest != digest([]byte("hello world!")) {
+		t.Fatalf("Expected the assembled payload of %v but got %v for %v", session, ref, completed)
+	}
+	if _, err := uploads.PutPart(ctx, "1", session.UploadID, 4, bytes.NewReader(nil)); !platform.CommandError(err) {
+		t.Fatalf("Expected staging a part of a completed upload to be a command error but got '%v'", err)
+	}
+	if _, again, err := uploads.Complete(ctx, "1", session.UploadID, payloads); err != nil || again != ref {
+		t.Fatalf("Expected completing the upload again to return %v but got %v, '%v'", ref, again, err)
+	}
+
+	repo := NewAggregateRepository(NewInMemoryEventStore(), WithPayloads(payloads))
+	blob, err := repo.Process(ctx, PutFromPayloadCommand("1", completed.BlobType, ref))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := repo.ReadData(ctx, blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello world!" {
+		t.Fatalf("Expected the blob data to be the upload but got %s", data)
+	}
+
+	if err := uploads.Remove(ctx, "1", session.UploadID); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := uploads.Complete(ctx, "1", session.UploadID, payloads); !platform.IsMissingAggregate(err) {
+		t.Fatalf("Expected a removed upload to be missing but got '%v'", err)
+	}
+}
+
+// blockingPayloadStore signals started when Put is called and waits for release before storing the data.
+type blockingPayloadStore struct {
+	PayloadStore
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b blockingPayloadStore) Put(ctx context.Context, r io.Reader) (PayloadRef, error) {
+	close(b.started)
+	<-b.release
+	return b.PayloadStore.Put(ctx, r)
+}
+
+func TestCompleteUploadOnlyBlocksItsSession(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uploads")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	uploads, err := NewLocalFileSystemUploadStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	completing, err := uploads.Initiate(ctx, "1", "text/plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := uploads.Initiate(ctx, "2", "text/plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := uploads.PutPart(ctx, "1", completing.UploadID, 1, bytes.NewReader([]byte("hello"))); err != nil {
+		t.Fatal(err)
+	}
+
+	payloads := blockingPayloadStore{PayloadStore: NewInMemoryPayloadStore(), started: make(chan struct{}), release: make(chan struct{})}
+	done := make(chan error)
+	go func() {
+		_, _, err := uploads.Complete(ctx, "1", completing.UploadID, payloads)
+		done <- err
+	}()
+	<-payloads.started
+
+	if _, err := uploads.PutPart(ctx, "2", other.UploadID, 1, bytes.NewReader([]byte("world"))); err != nil {
+		t.Fatalf("Expected a part of another upload to be staged while completing but got '%v'", err)
+	}
+	if _, err := uploads.Expire(ctx, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := uploads.PutPart(ctx, "1", completing.UploadID, 2, bytes.NewReader(nil)); !platform.CommandError(err) {
+		t.Fatalf("Expected staging a part of a completing upload to be a command error but got '%v'", err)
+	}
+	if err := uploads.Remove(ctx, "1", completing.UploadID); !platform.CommandError(err) {
+		t.Fatalf("Expected removing a completing upload to be a command error but got '%v'", err)
+	}
+	if _, _, err := uploads.Complete(ctx, "1", completing.UploadID, payloads); !platform.CommandError(err) {
+		t.Fatalf("Expected completing a completing upload to be a command error but got '%v'", err)
+	}
+
+	close(payloads.release)
+	if err := <-done; err != nil {
+		t.Fatalf("Expected the upload kept by Expire to be completed but got '%v'", err)
+	}
+	if session, _, err := uploads.Session(ctx, "1", completing.UploadID); err != nil || session.Payload == nil {
+		t.Fatalf("Expected the completed session but got %v, '%v'", session, err)
+	}
+}
+
+func TestCompleteUploadAfterFailedCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uploads")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	uploads, err := NewLocalFileSystemUploadStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payloads := NewInMemoryPayloadStore()
+	repo := NewAggregateRepository(NewInMemoryEventStore(), WithPayloads(payloads))
+	ctx := context.Background()
+
+	for _, cmd := range []Command{CreateCommand("1", "text/plain", []byte("old")), DeleteCommand("1")} {
+		if _, err := repo.Process(ctx, cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	session, err := uploads.Initiate(ctx, "1", "text/plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := uploads.PutPart(ctx, "1", session.UploadID, 1, bytes.NewReader([]byte("new"))); err != nil {
+		t.Fatal(err)
+	}
+
+	_, ref, err := uploads.Complete(ctx, "1", session.UploadID, payloads)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.Process(ctx, PutFromPayloadCommand("1", session.BlobType, ref)); !platform.CommandError(err) {
+		t.Fatalf("Expected uploading to a deleted blob to be a command error but got '%v'", err)
+	}
+	if _, err := repo.Process(ctx, RestoreCommand("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	_, ref, err = uploads.Complete(ctx, "1", session.UploadID, payloads)
+	if err != nil {
+		t.Fatalf("Expected the upload to survive the failed command but got '%v'", err)
+	}
+	blob, err := repo.Process(ctx, PutFromPayloadCommand("1", session.BlobType, ref))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := repo.ReadData(ctx, blob); err != nil || string(data) != "new" {
+		t.Fatalf("Expected the blob data to be the upload but got %s, '%v'", data, err)
+	}
+	if _, err := repo.Process(ctx, PutFromPayloadCommand("1", "application/json", ref)); !platform.CommandError(err) {
+		t.Fatalf("Expected a different BlobType to be a command error but got '%v'", err)
+	}
+}
+
+func TestExpireUploads(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uploads")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	uploads, err := NewLocalFileSystemUploadStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	abandoned, err := uploads.Initiate(ctx, "1", "text/plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(path.Join(dir, abandoned.UploadID), old, old); err != nil {
+		t.Fatal(err)
+	}
+	active, err := uploads.Initiate(ctx, "1", "text/plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expired, err := uploads.Expire(ctx, time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expired != 1 {
+		t.Fatalf("Expected 1 expired upload but got %d", expired)
+	}
+	if _, _, err := uploads.Session(ctx, "1", abandoned.UploadID); !platform.IsMissingAggregate(err) {
+		t.Fatalf("Expected the abandoned upload to be removed but got '%v'", err)
+	}
+	if _, _, err := uploads.Session(ctx, "1", active.UploadID); err != nil {
+		t.Fatal(err)
+	}
+}
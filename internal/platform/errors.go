@@ -10,6 +10,22 @@ func IsMissingAggregate(err error) bool {
 	return ok && ime.IsMissingAggregate()
 }
 
+func IsConcurrencyConflict(err error) bool {
+	type isconcurrencyconflict interface {
+		IsConcurrencyConflict() bool
+	}
+	icc, ok := errors.Cause(err).(isconcurrencyconflict)
+	return ok && icc.IsConcurrencyConflict()
+}
+
+func IsRetriesExhausted(err error) bool {
+	type isretriesexhausted interface {
+		IsRetriesExhausted() bool
+	}
+	ire, ok := errors.Cause(err).(isretriesexhausted)
+	return ok && ire.IsRetriesExhausted()
+}
+
 func CommandError(err error) bool {
 	type commandError interface {
 		CommandError() bool
@@ -17,3 +33,19 @@ func CommandError(err error) bool {
 	br, ok := errors.Cause(err).(commandError)
 	return ok && br.CommandError()
 }
+
+func IsPreconditionFailed(err error) bool {
+	type ispreconditionfailed interface {
+		IsPreconditionFailed() bool
+	}
+	ipf, ok := errors.Cause(err).(ispreconditionfailed)
+	return ok && ipf.IsPreconditionFailed()
+}
+
+func IsIdempotencyConflict(err error) bool {
+	type isidempotencyconflict interface {
+		IsIdempotencyConflict() bool
+	}
+	iic, ok := errors.Cause(err).(isidempotencyconflict)
+	return ok && iic.IsIdempotencyConflict()
+}
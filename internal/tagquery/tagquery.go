@@ -0,0 +1,334 @@
+// Package tagquery parses and evaluates queries over tags such as
+//
+//	env=prod AND (team=search OR team=ads) AND NOT has(archived)
+//
+// A query combines comparisons with NOT, AND and OR, in decreasing order of precedence, and parentheses.
+// The comparisons are key=value, key!=value, key^=prefix and has(key). Keys and values are either words of
+// letters, digits and any of _ . / : - or double quoted strings.
+package tagquery
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Expr is a parsed query.
+type Expr interface {
+	// Match reports whether tags match the query.
+	Match(tags map[string]string) bool
+	String() string
+}
+
+type And struct {
+	Left, Right Expr
+}
+
+func (a And) Match(tags map[string]string) bool {
+	return a.Left.Match(tags) && a.Right.Match(tags)
+}
+
+func (a And) String() string {
+	return fmt.Sprintf("(%v AND %v)", a.Left, a.Right)
+}
+
+type Or struct {
+	Left, Right Expr
+}
+
+func (o Or) Match(tags map[string]string) bool {
+	return o.Left.Match(tags) || o.Right.Match(tags)
+}
+
+func (o Or) String() string {
+	return fmt.Sprintf("(%v OR %v)", o.Left, o.Right)
+}
+
+type Not struct {
+	Expr Expr
+}
+
+func (n Not) Match(tags map[string]string) bool {
+	return !n.Expr.Match(tags)
+}
+
+func (n Not) String() string {
+	return fmt.Sprintf("NOT %v", n.Expr)
+}
+
+// Equals matches tags with the Key set to Value.
+type Equals struct {
+	Key, Value string
+}
+
+func (e Equals) Match(tags map[string]string) bool {
+	value, ok := tags[e.Key]
+	return ok && value == e.Value
+}
+
+func (e Equals) String() string {
+	return fmt.Sprintf("%q=%q", e.Key, e.Value)
+}
+
+// NotEquals matches tags with the Key set to anything but Value, including tags without the Key.
+type NotEquals struct {
+	Key, Value string
+}
+
+func (n NotEquals) Match(tags map[string]string) bool {
+	value, ok := tags[n.Key]
+	return !ok || value != n.Value
+}
+
+func (n NotEquals) String() string {
+	return fmt.Sprintf("%q!=%q", n.Key, n.Value)
+}
+
+// Prefix matches tags with the Key set to a value starting with Prefix.
+type Prefix struct {
+	Key, Prefix string
+}
+
+func (p Prefix) Match(tags map[string]string) bool {
+	value, ok := tags[p.Key]
+	return ok && strings.HasPrefix(value, p.Prefix)
+}
+
+func (p Prefix) String() string {
+	return fmt.Sprintf("%q^=%q", p.Key, p.Prefix)
+}
+
+// Has matches tags with the Key.
+type Has struct {
+	Key string
+}
+
+func (h Has) Match(tags map[string]string) bool {
+	_, ok := tags[h.Key]
+	return ok
+}
+
+func (h Has) String() string {
+	return fmt.Sprintf("has(%q)", h.Key)
+}
+
+// ParseError is returned by Parse for invalid queries. Pos is the byte offset of the error in the query.
+type ParseError struct {
+	Pos int
+	Msg string
+}
+
+func (p ParseError) Error() string {
+	return fmt.Sprintf("invalid tag query at position %d: %s", p.Pos, p.Msg)
+}
+
+// Parse parses the query into an Expr or returns a ParseError.
+func Parse(query string) (Expr, error) {
+	tokens, err := lex(query)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokenEOF {
+		return nil, ParseError{Pos: tok.pos, Msg: fmt.Sprintf("unexpected %v", tok)}
+	}
+	return expr, nil
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenWord
+	tokenString
+	tokenOp
+	tokenLParen
+	tokenRParen
+)
+
+type token struct {
+	kind  tokenKind
+	value string
+	pos   int
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokenEOF:
+		return "end of query"
+	case tokenString:
+		return strconv.Quote(t.value)
+	}
+	return fmt.Sprintf("%q", t.value)
+}
+
+// keyword reports whether the token is the keyword, which is case insensitive.
+func (t token) keyword(keyword string) bool {
+	return t.kind == tokenWord && strings.EqualFold(t.value, keyword)
+}
+
+func isWordChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.IndexByte("_./:-", c) >= 0
+}
+
+func lex(query string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case c == '(':
+			tokens = append(tokens, token{kind: tokenLParen, value: "(", pos: i})
+			i++
+		case c == ')':
+			tokens = append(tokens, token{kind: tokenRParen, value: ")", pos: i})
+			i++
+		case c == '=':
+			tokens = append(tokens, token{kind: tokenOp, value: "=", pos: i})
+			i++
+		case (c == '!' || c == '^') && i+1 < len(query) && query[i+1] == '=':
+			tokens = append(tokens, token{kind: tokenOp, value: query[i : i+2], pos: i})
+			i += 2
+		case c == '"':
+			value, err := strconv.QuotedPrefix(query[i:])
+			if err != nil {
+				return nil, ParseError{Pos: i, Msg: "unterminated string"}
+			}
+			unquoted, _ := strconv.Unquote(value)
+			tokens = append(tokens, token{kind: tokenString, value: unquoted, pos: i})
+			i += len(value)
+		case isWordChar(c):
+			start := i
+			for i < len(query) && isWordChar(query[i]) {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenWord, value: query[start:i], pos: start})
+		default:
+			return nil, ParseError{Pos: i, Msg: fmt.Sprintf("unexpected character %q", c)}
+		}
+	}
+	return append(tokens, token{kind: tokenEOF, pos: len(query)}), nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokenEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *parser) parseOr() (Expr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().keyword("OR") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = Or{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (Expr, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().keyword("AND") {
+		p.next()
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = And{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseNot() (Expr, error) {
+	if p.peek().keyword("NOT") {
+		p.next()
+		expr, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return Not{expr}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (Expr, error) {
+	tok := p.next()
+	switch {
+	case tok.kind == tokenLParen:
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(tokenRParen, "closing parenthesis"); err != nil {
+			return nil, err
+		}
+		return expr, nil
+	case tok.keyword("has") && p.peek().kind == tokenLParen:
+		p.next()
+		key, err := p.parseText("key")
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(tokenRParen, "closing parenthesis"); err != nil {
+			return nil, err
+		}
+		return Has{key}, nil
+	case tok.kind == tokenWord || tok.kind == tokenString:
+		op := p.next()
+		if op.kind != tokenOp {
+			return nil, ParseError{Pos: op.pos, Msg: fmt.Sprintf("expected =, != or ^= after key %q but got %v", tok.value, op)}
+		}
+		value, err := p.parseText("value")
+		if err != nil {
+			return nil, err
+		}
+		switch op.value {
+		case "!=":
+			return NotEquals{tok.value, value}, nil
+		case "^=":
+			return Prefix{tok.value, value}, nil
+		}
+		return Equals{tok.value, value}, nil
+	}
+	return nil, ParseError{Pos: tok.pos, Msg: fmt.Sprintf("expected a comparison but got %v", tok)}
+}
+
+func (p *parser) parseText(what string) (string, error) {
+	tok := p.next()
+	if tok.kind != tokenWord && tok.kind != tokenString {
+		return "", ParseError{Pos: tok.pos, Msg: fmt.Sprintf("expected a %s but got %v", what, tok)}
+	}
+	return tok.value, nil
+}
+
+func (p *parser) expect(kind tokenKind, what string) error {
+	if tok := p.next(); tok.kind != kind {
+		return ParseError{Pos: tok.pos, Msg: fmt.Sprintf("expected %s but got %v", what, tok)}
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package tagquery
+
+import (
+	"testing"
+)
+
+func TestParseAndMatch(t *testing.T) {
+	tags := map[string]string{"env": "prod", "team": "search", "region": "us-east-1", "owner name": "a b"}
+
+	tests := map[string]struct {
+		Query    string
+		Expected bool
+	}{
+		"equals":                       {"env=prod", true},
+		"equals another value":         {"env=dev", false},
+		"not equals":                   {"env!=dev", true},
+		"not equals a missing key":     {"tier!=gold", true},
+		"prefix":                       {"region^=us-", true},
+		"prefix of another value":      {"region^=eu-", false},
+		"has":                          {"has(team)", true},
+		"has a missing key":            {"has(archived)", false},
+		"quoted key and value":         {`"owner name"="a b"`, true},
+		"and":                          {"env=prod AND team=ads", false},
+		"or":                           {"env=dev OR team=search", true},
+		"not":                          {"NOT has(archived)", true},
+		"and binds tighter than or":    {"env=dev AND team=ads OR team=search", true},
+		"parentheses":                  {"env=dev AND (team=ads OR team=search)", false},
+		"lower case keywords":          {"env=prod and not has(archived)", true},
+		"nested not":                   {"NOT NOT env=prod", true},
+		"example from the description": {"env=prod AND (team=search OR team=ads) AND NOT has(archived)", true},
+	}
+	for testName, data := range tests {
+		t.Run(testName, func(t *testing.T) {
+			expr, err := Parse(data.Query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if actual := expr.Match(tags); actual != data.Expected {
+				t.Fatalf("Expected %v to match %v but got %v", expr, data.Expected, actual)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := map[string]struct {
+		Query       string
+		ExpectedPos int
+	}{
+		"empty query":            {"", 0},
+		"missing value":          {"env=", 4},
+		"missing operator":       {"env prod", 4},
+		"unbalanced parenthesis": {"(env=prod", 9},
+		"trailing tokens":        {"env=prod team=ads", 9},
+		"unterminated string":    {`env="prod`, 4},
+		"unexpected character":   {"env=prod & team=ads", 9},
+		"has without a key":      {"has()", 4},
+		"dangling and":           {"env=prod AND", 12},
+	}
+	for testName, data := range tests {
+		t.Run(testName, func(t *testing.T) {
+			_, err := Parse(data.Query)
+			parseErr, ok := err.(ParseError)
+			if !ok {
+				t.Fatalf("Expected a ParseError but got '%v'", err)
+			}
+			if parseErr.Pos != data.ExpectedPos {
+				t.Fatalf("Expected the error at position %d but got '%v'", data.ExpectedPos, parseErr)
+			}
+		})
+	}
+}